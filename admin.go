@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// handleAdminConfig shows the configuration in effect, without secrets.
+// It is only served with the admin token, sent like the tenant tokens
+func (a *app) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	conf := a.config
+	if conf == nil || conf.AdminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token := r.Header.Get("X-Prerender-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(conf.AdminToken)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid or missing admin token"})
+		return
+	}
+	writeJSON(w, http.StatusOK, conf.Redacted())
+}
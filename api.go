@@ -1,170 +1,371 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
+	"strconv"
 	"time"
+	"unicode/utf8"
 	"strings"
-	"regexp"
-	"strconv"
-	"os"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/jsonld"
+	"github.com/Mixelito/prerender/ratelimit"
 	"github.com/Mixelito/prerender/render"
-	_ "github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/changes"
+	"github.com/pkg/errors"
 )
 
 func handle(w http.ResponseWriter, r *http.Request) (*render.Result) {
-	reqURL := r.URL.String()[1:]
-
-	//if decoded url has two query params from a decoded escaped fragment for hashbang URLs
-	if strings.Index("?", reqURL) != strings.LastIndex("?", reqURL) {
-		reqURL = reqURL[0:strings.LastIndex("?", reqURL)] + "&" + reqURL[strings.LastIndex("?", reqURL)+1:]
+	var opts *renderOptions
+	var err error
+	if r.URL.Path == "/render" || r.URL.Path == "/meta" {
+		opts, err = queryOptions(r)
+		if err == nil && r.URL.Path == "/meta" {
+			opts.Format = formatMeta
+		}
+	} else {
+		opts, err = legacyOptions(r)
 	}
-
-	if reqURL == "" {
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "url is required")
+		fmt.Fprint(w, err.Error())
 		return nil
 	}
 
-	reqURLFinal, err := url.QueryUnescape(reqURL)
-	if err != nil {
-		reqURLFinal = reqURL
-	}
+	r.URL = opts.URL
+	r = r.WithContext(setOptions(r.Context(), opts))
 
-	u, err := url.Parse(reqURLFinal)
-	if err != nil || !u.IsAbs() {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Invalid URL")
-		return nil
+	res, err := getData(r)
+	if opts.Debug && res != nil {
+		setDebugHeaders(w.Header(), res)
 	}
+	writeResult(res, err, w, opts.Format)
+	return res
+}
 
-	//http://www.example.com?_escaped_fragment_=key1=value1%26key2=value2
-	//to http://www.example.com#!key1=value1&key2=value2
-	// Remove the _escaped_fragment_ query parameter
-	urlQuery := u.Query()
-	if urlQuery != nil && urlQuery["_escaped_fragment_"] != nil {
+// maxDebugErrors bounds the X-Prerender-Error headers of a response
+const maxDebugErrors = 10
 
-		if urlQuery.Get("_escaped_fragment_") != "" {
-			u.Path = "#!" + urlQuery.Get("_escaped_fragment_")
+// setDebugHeaders adds to h the number of errors of the page and the
+// first of them: its uncaught exceptions, then the messages logged as
+// errors
+func setDebugHeaders(h http.Header, res *render.Result) {
+	var errs []string
+	for _, e := range res.Exceptions {
+		errs = append(errs, e.Message)
+	}
+	for _, m := range res.Console {
+		if m.Level == "error" {
+			errs = append(errs, m.Text)
+		}
+	}
+	h.Set("X-Prerender-Errors", strconv.Itoa(len(errs)))
+	for i, e := range errs {
+		if i == maxDebugErrors {
+			break
 		}
+		h.Add("X-Prerender-Error", headerValue(e))
+	}
+}
 
-		urlQuery.Del("_escaped_fragment_")
-		u.RawQuery = urlQuery.Encode()
+// headerValue makes s fit on a single, short header line
+func headerValue(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= 200 {
+		return s
+	}
+	end := 200
+	for !utf8.RuneStart(s[end]) {
+		end--
 	}
+	return s[:end] + "..."
+}
 
-	r.URL = u
+// endpoints are the paths served by the API rather than rendered
+var endpoints = map[string]bool{
+	"/render":       true,
+	"/render/batch": true,
+	"/meta":         true,
+	"/jobs":         true,
+	"/metrics":      true,
+	"/healthz":      true,
+	"/readyz":       true,
+	"/admin/config": true,
+}
 
-	res, err := getData(r)
-	writeResult(res, err, w)
-	return res
+// isLegacyPath reports whether path is a URL to render rather than one of
+// the endpoints
+func isLegacyPath(path string) bool {
+	return !endpoints[path] && !strings.HasPrefix(path, "/jobs/")
 }
 
+const (
+	formatHTML = "html"
+	formatJSON = "json"
+	// formatHAR responds the HAR of the render only
+	formatHAR = "har"
+	// formatMeta responds the SEO metadata of the page only
+	formatMeta = "meta"
+	// formatJSONLD responds the validation of the JSON-LD of the page
+	formatJSONLD = "jsonld"
+)
+
 func getData(r *http.Request) (*render.Result, error) {
+	opts := getOptions(r.Context())
+	if policy := getPolicy(r.Context()); policy != nil {
+		if err := policy.Check(r.Context(), r.URL); err != nil {
+			return nil, err
+		}
+	}
+
 	cache := getCache(r.Context())
-	if cache != nil && r.Method != "POST" {
+	if cache != nil && opts.Refresh {
+		cacheRequests.WithLabelValues(cacheBackend(cache), "bypass").Inc()
+	} else if cache != nil {
 		res, err := cache.Check(r)
-		if err != nil || res != nil {
+		if err != nil {
+			cacheRequests.WithLabelValues(cacheBackend(cache), "error").Inc()
+			return nil, err
+		}
+		if res != nil {
+			result := "hit"
+			if res.Status == http.StatusNotModified {
+				result = "not_modified"
+			}
+			cacheRequests.WithLabelValues(cacheBackend(cache), result).Inc()
 			res.Cached = true
-			return res, err
+			if res.URL == "" {
+				res.URL = r.URL.String()
+			}
+			return res, nil
+		}
+		cacheRequests.WithLabelValues(cacheBackend(cache), "miss").Inc()
+	}
+
+	if limits := getRateLimits(r.Context()); limits != nil {
+		if err := limits.allowOrigin(r.Context(), r.URL.Hostname()); err != nil {
+			return nil, err
 		}
 	}
 
 	renderer := getRenderer(r.Context())
-	res, err := renderer.Render(r)
-	if err == nil && res.Status == http.StatusOK && cache != nil {
+	start := time.Now()
+	res, err := renderer.Render(r.WithContext(render.WithOptions(r.Context(), opts.Render)))
+	observeRender(res, err, start)
+	if err != nil || res.Status != http.StatusOK {
+		return res, err
+	}
+	if err = getPipeline(r.Context()).Process(r.Context(), res); err != nil {
+		return nil, err
+	}
+	// processors change the HTML, the metadata is that of the page served
+	res.Meta = render.ExtractMetadata(res.HTML)
+	if res.HAR != nil && res.Meta.Title != "" {
+		res.HAR.Log.Pages[0].Title = res.Meta.Title
+	}
+	if res.StructuredData != nil && !res.StructuredData.Valid {
+		log.WithFields(log.Fields{
+			"url":    res.URL,
+			"errors": structuredDataErrors(res.StructuredData),
+		}).Warn("invalid structured data")
+	}
+	if res.Failure != "" {
+		log.WithFields(log.Fields{"url": res.URL, "status": res.Status, "failure": res.Failure}).Warn("not caching broken page")
+		return res, nil
+	}
+	if cache != nil {
+		if d := getChanges(r.Context()); d != nil {
+			detectChanges(r.Context(), d, cache, res)
+		}
 		err = cache.Save(res, 24*time.Hour)
 	}
 	return res, err
 }
 
-func writeResult(res *render.Result, err error, w http.ResponseWriter) {
+// detectChanges compares res with the snapshot of the previous render of
+// its page, and posts the change of its content if there is one. The
+// snapshot of res is kept for the next render, longer than the page is
+// cached. Caches without snapshots compare with the cached page
+func detectChanges(ctx context.Context, d *changes.Detector, c cache.Cache, res *render.Result) {
+	fields := log.Fields{"url": res.URL}
+	old, err := previousSnapshot(d, c, res.URL)
+	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("error getting previous snapshot to detect changes")
+		return
+	}
+	change, snap, err := d.Compare(old, res)
 	if err != nil {
+		log.WithError(err).WithFields(fields).Warn("error detecting changes")
+		return
+	}
+	if store, ok := c.(cache.SnapshotStore); ok {
+		data, err := json.Marshal(snap)
+		if err == nil {
+			err = store.SaveSnapshot(res.URL, data, changes.SnapshotTTL)
+		}
+		if err != nil {
+			log.WithError(err).WithFields(fields).Warn("error saving snapshot to detect changes")
+		}
+	}
+	if change == nil {
+		return
+	}
+	if t := getTenant(ctx); t != nil {
+		change.Tenant = t.Name
+		fields["tenant"] = t.Name
+	}
+	contentChanges.Inc()
+	fields["oldHash"], fields["newHash"] = change.OldHash, change.NewHash
+	log.WithFields(fields).Info("content changed: " + change.Diff.Summary)
+	d.Notify(change)
+}
+
+// previousSnapshot returns the snapshot of the previous render of a page,
+// or nil when it was never rendered or its snapshot expired
+func previousSnapshot(d *changes.Detector, c cache.Cache, url string) (*changes.Snapshot, error) {
+	if store, ok := c.(cache.SnapshotStore); ok {
+		data, err := store.Snapshot(url)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		var snap changes.Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, errors.Wrap(err, "decoding snapshot failed")
+		}
+		return &snap, nil
+	}
+	m, ok := c.(cache.Manager)
+	if !ok {
+		return nil, nil
+	}
+	old, _, err := m.Get(url)
+	if err != nil || old == nil {
+		return nil, err
+	}
+	return d.Snapshot(old)
+}
+
+func writeResult(res *render.Result, err error, w http.ResponseWriter, format string) {
+	if err != nil {
+		status := http.StatusInternalServerError
 		if err == render.ErrPageLoadTimeout {
-			w.WriteHeader(http.StatusGatewayTimeout)
+			status = http.StatusGatewayTimeout
+		} else if errors.Cause(err) == guard.ErrForbidden {
+			status = http.StatusForbidden
+		} else if limited, ok := err.(*ratelimit.LimitedError); ok {
+			status = http.StatusTooManyRequests
+			setRetryAfter(w.Header(), limited)
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
 			log.WithError(err).Errorf("error rendering")
 		}
+		if format != formatHTML {
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+		} else {
+			w.WriteHeader(status)
+			if status == http.StatusForbidden || status == http.StatusTooManyRequests {
+				fmt.Fprint(w, err.Error())
+			}
+		}
 		return
 	}
 
-	if res.Status != http.StatusOK {
-		w.WriteHeader(res.Status)
+	if res.Etag != "" && res.Status == http.StatusOK {
+		w.Header().Add("Etag", res.Etag)
+	}
+	for name, values := range res.Headers {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+
+	if format == formatHAR {
+		writeJSON(w, res.Status, res.HAR)
 		return
 	}
-	if res.Etag != "" {
-		w.Header().Add("Etag", res.Etag)
+	if format == formatMeta && res.Status != http.StatusNotModified {
+		writeJSON(w, res.Status, pageMeta(res))
+		return
+	}
+	if format == formatJSONLD && res.Status != http.StatusNotModified {
+		writeJSON(w, res.Status, structuredData(res))
+		return
 	}
+	if format == formatJSON && res.Status != http.StatusNotModified {
+		withMeta(res)
+		writeJSON(w, res.Status, res)
+		return
+	}
+
+	w.WriteHeader(res.Status)
 	if res.HTML != "" {
-		//prerender-status-code
-		if os.Getenv("PLUGIN_STATUS_CODE") != "false" {
-			statusMatch, _ := regexp.Compile("<meta[^<>]*(?:name=['\"]prerender-status-code['\"][^<>]*content=['\"]([0-9]{3})['\"]|content=['\"]([0-9]{3})['\"][^<>]*name=['\"]prerender-status-code['\"])[^<>]*>")
-			headerMatch, _ := regexp.Compile("<meta[^<>]*(?:name=['\"]prerender-header['\"][^<>]*content=['\"]([^'\"]*?): ?([^'\"]*?)['\"]|content=['\"]([^'\"]*?): ?([^'\"]*?)['\"][^<>]*name=['\"]prerender-header['\"])[^<>]*>")
-			head := strings.Split(res.HTML, "</head>")[0]
-
-			var match2 [][]string = headerMatch.FindAllStringSubmatch(head, -1)
-			if match2 != nil {
-				for index, element := range match2 {
-					_ = index
-					var headerName string
-					var headerValue string
-
-					if element[1] != "" {
-						headerName = element[1]
-					} else if element[3] != "" {
-						headerName = element[3]
-					}
-
-					if element[2] != "" {
-						headerValue = element[2]
-					} else if element[4] != "" {
-						headerValue = element[4]
-					}
-
-					w.Header().Add(headerName, headerValue)
-					res.HTML = strings.Replace(res.HTML, element[0], "", -1)
-				}
-			}
+		fmt.Fprint(w, res.HTML)
+	}
+}
 
-			var match []string = statusMatch.FindStringSubmatch(head)
-			if match != nil {
-				var finalMatch string
-				if match[1] != "" {
-					finalMatch = match[1]
-				} else if match[2] != "" {
-					finalMatch = match[2]
-				}
-
-				statusCode, err := strconv.ParseInt(finalMatch, 10, 64)
-				_ = err
-				if statusCode != 0 && statusCode != 200 {
-					w.WriteHeader(int(statusCode))
-				}
-				res.HTML = strings.Replace(res.HTML, match[0], "", -1)
-			}
-		}
+// withMeta sets the metadata of results cached without it
+func withMeta(res *render.Result) {
+	if res.Meta == nil && res.HTML != "" {
+		res.Meta = render.ExtractMetadata(res.HTML)
+	}
+}
 
-		//removeScriptTags
-		if os.Getenv("PLUGIN_SCRIPT_TAGS") != "false" {
-			scriptMatch := regexp.MustCompile(`(?i)<script(?:.*?)>(?:[\S\s]*?)<\/script>`)
-			var match3 [][]string = scriptMatch.FindAllStringSubmatch(res.HTML, -1)
-			if match3 != nil {
-				for index, element := range match3 {
-					_ = index
-					for index2, element2 := range element {
-						_ = element2
-						if strings.Index(element[index2], "application/ld+json") == -1 {
-							res.HTML = strings.Replace(res.HTML, element[index2], "", -1)
-						}
-					}
-				}
-			}
-		}
+// pageMetaResponse is the response of format meta
+type pageMetaResponse struct {
+	URL      string           `json:"url"`
+	FinalURL string           `json:"finalUrl,omitempty"`
+	Status   int              `json:"status"`
+	Cached   bool             `json:"cached"`
+	Meta     *render.Metadata `json:"meta"`
+}
 
-		fmt.Fprint(w, res.HTML)
+func pageMeta(res *render.Result) *pageMetaResponse {
+	withMeta(res)
+	return &pageMetaResponse{
+		URL:      res.URL,
+		FinalURL: res.FinalURL,
+		Status:   res.Status,
+		Cached:   res.Cached,
+		Meta:     res.Meta,
+	}
+}
+
+// structuredDataResponse is the response of format jsonld
+type structuredDataResponse struct {
+	URL      string `json:"url"`
+	FinalURL string `json:"finalUrl,omitempty"`
+	Status   int    `json:"status"`
+	Cached   bool   `json:"cached"`
+	*jsonld.Report
+}
+
+// structuredData validates the JSON-LD of results the validateJsonLd
+// processor didn't
+func structuredData(res *render.Result) *structuredDataResponse {
+	if res.StructuredData == nil {
+		res.StructuredData = jsonld.Validate(res.HTML)
+	}
+	return &structuredDataResponse{
+		URL:      res.URL,
+		FinalURL: res.FinalURL,
+		Status:   res.Status,
+		Cached:   res.Cached,
+		Report:   res.StructuredData,
+	}
+}
 
+// structuredDataErrors lists the errors of a report with the line of
+// their script
+func structuredDataErrors(r *jsonld.Report) []string {
+	var errs []string
+	for _, b := range r.Blocks {
+		for _, e := range b.Errors {
+			errs = append(errs, fmt.Sprintf("line %d: %s", b.Line, e))
+		}
 	}
+	return errs
 }
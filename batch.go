@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Mixelito/prerender/jobs"
+	log "github.com/Sirupsen/logrus"
+)
+
+type batchRequest struct {
+	URLs    []string          `json:"urls"`
+	Options map[string]string `json:"options"`
+}
+
+// handleBatch renders several URLs concurrently and streams each result
+// back as a line of NDJSON as soon as it is done
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var br batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&br); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "invalid batch")
+		return
+	}
+	if t := getTenant(r.Context()); t != nil {
+		br.Options = t.withDefaults(br.Options)
+	}
+	if len(br.URLs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "urls are required")
+		return
+	}
+	conf := getConfig(r.Context()).Batch
+	if max := conf.MaxURLs; len(br.URLs) > max {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "at most %d urls are allowed", max)
+		return
+	}
+	for _, u := range br.URLs {
+		if _, err := mapOptions(u, br.Options); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s: %s", err, u)
+			return
+		}
+	}
+
+	// the renderer enforces the tab limit, this only bounds the
+	// number of goroutines waiting for a tab
+	concurrency := conf.Concurrency
+	urls := make(chan string)
+	results := make(chan jobs.Result)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(br.URLs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range urls {
+				result, _ := renderURL(r.Context(), u, br.Options)
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		defer close(urls)
+		for _, u := range br.URLs {
+			select {
+			case urls <- u:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for result := range results {
+		if err := enc.Encode(result); err != nil {
+			log.WithError(err).Error("error writing batch result")
+			continue
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
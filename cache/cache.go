@@ -3,7 +3,7 @@ package cache
 import (
 	"net/http"
 	"time"
-	"os"
+	"github.com/Mixelito/prerender/config"
 	"github.com/Mixelito/prerender/render"
 	"github.com/pkg/errors"
 
@@ -17,15 +17,19 @@ import (
 	"unicode/utf8"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"strconv"
 )
 
 type RedisCache struct {
 	client *redis.Client
+	prefix string
 }
 
 type S3Cache struct {
 	client *minio.Client
 	bucket string
+	prefix string
 }
 
 // Cache caches prerendering results for quick retrieval later
@@ -34,7 +38,55 @@ type Cache interface {
 	Save(*render.Result, time.Duration) error
 }
 
-var storeType = os.Getenv("CACHE")
+// Namespacer is implemented by caches able to keep separate entries per
+// namespace, so tenants can't read each other's pages
+type Namespacer interface {
+	WithNamespace(ns string) Cache
+}
+
+// Pinger is implemented by caches able to check their backend is reachable
+type Pinger interface {
+	Ping() error
+}
+
+// Manager is implemented by caches whose entries can be inspected and
+// removed, as the cache command does
+type Manager interface {
+	// Get returns the page cached for url and its entry, or nil when
+	// there is none
+	Get(url string) (*render.Result, *Entry, error)
+	// List calls f with the entries whose URL starts with prefix
+	List(prefix string, f func(Entry) error) error
+	// Delete removes the page cached for url
+	Delete(url string) error
+}
+
+// SnapshotStore is implemented by caches able to keep snapshots of pages
+// for longer than the pages themselves, to detect changes between renders
+// far apart
+type SnapshotStore interface {
+	// Snapshot returns the snapshot saved for url, or nil when there is
+	// none
+	Snapshot(url string) ([]byte, error)
+	// SaveSnapshot keeps the snapshot of url for ttl
+	SaveSnapshot(url string, data []byte, ttl time.Duration) error
+}
+
+// Entry describes a cached page
+type Entry struct {
+	URL string `json:"url"`
+	// Key is the name of the entry in the backend
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+	// TTL is the time left before the entry expires, 0 when it doesn't
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// isPage tells whether a key without its namespace is the one of a page,
+// rather than of another namespace or of the jobs sharing the backend
+func isPage(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
 
 /*
 // NewCache creates a new caching layer using Redis as backend
@@ -51,45 +103,49 @@ func NewCache(client *redis.Client) Cache {
     //yes, here is another method:
     var _ Iface = (*MyType)(nil)
  */
-// NewCache creates a new caching layer using Redis as backend
-func NewCache() Cache {
-	if storeType=="redis" {
-
-		redisAddr := os.Getenv("REDIS_URL")
-		if redisAddr == "" {
-			redisAddr = "redis://localhost:6379/0"
-		}
-		opts, err := redis.ParseURL(redisAddr)
+// NewCache creates a new caching layer using the configured backend,
+// Redis or S3. It returns nil when caching is disabled
+func NewCache(c config.Cache) (Cache, error) {
+	if c.Backend=="redis" {
+		opts, err := redis.ParseURL(c.RedisURL)
 		if err != nil {
-			log.Fatal("error parsing redis url", err)
+			return nil, errors.Wrap(err, "error parsing redis url")
 		}
 		client := redis.NewClient(opts)
-		defer client.Close()
-
-		return &RedisCache{client}
-	} else if storeType=="s3" {
-		awsAccessKey := os.Getenv("AWS_ACCESS_KEY_ID")
-		awsSecret := os.Getenv("AWS_SECRET_ACCESS_KEY")
-		awsBucket := os.Getenv("AWS_S3_BUCKET_NAME")
-		awsRegion := os.Getenv("AWS_REGION")
-		if awsRegion=="" {
-			awsRegion = "us-east-1"
-		}
 
-		client, err := minio.NewWithRegion("s3.amazonaws.com", awsAccessKey, awsSecret, true, awsRegion)
+		return &RedisCache{client: client}, nil
+	} else if c.Backend=="s3" {
+		client, err := minio.NewWithRegion("s3.amazonaws.com", c.S3.AccessKey, c.S3.SecretKey, true, c.S3.Region)
 
 		if err != nil {
-			log.Fatal("error authenticate aws s3", err)
+			return nil, errors.Wrap(err, "error authenticate aws s3")
 		}
 
-		return &S3Cache{client,awsBucket}
+		return &S3Cache{client: client, bucket: c.S3.Bucket}, nil
 	}
-	return nil
+	return nil, nil
+}
+
+// WithNamespace returns a cache sharing the client whose keys are
+// prefixed with ns
+func (c *RedisCache) WithNamespace(ns string) Cache {
+	return &RedisCache{client: c.client, prefix: ns + ":"}
+}
+
+func (c *RedisCache) key(url string) string {
+	return c.prefix + url
+}
+
+// snapshotKey is out of the pages of every namespace, which start with
+// their URL
+func (c *RedisCache) snapshotKey(url string) string {
+	return "prerender:snapshot:" + c.prefix + url
 }
 
+// checkEtag looks the etag up under the full URL, like the page is saved
 func (c *RedisCache) checkEtag(r *http.Request) (bool, error) {
 	if etag := r.Header.Get("If-None-Match"); etag != "" {
-		redisEtag, err := c.client.HGet(r.URL.Path, "Etag").Result()
+		redisEtag, err := c.client.HGet(c.key(r.URL.String()), "Etag").Result()
 		if err != nil && err != redis.Nil {
 			return false, errors.Wrap(err, "getting cached etag failed")
 		}
@@ -107,7 +163,7 @@ func (c *RedisCache) Check(r *http.Request) (*render.Result, error) {
 		return &render.Result{Status: http.StatusNotModified}, nil
 	}
 
-	data, err := c.client.HGetAll(r.URL.String()).Result()
+	data, err := c.client.HGetAll(c.key(r.URL.String())).Result()
 	if err != nil {
 		return nil, errors.Wrap(err, "getting cached data failed")
 	}
@@ -121,21 +177,125 @@ func (c *RedisCache) Check(r *http.Request) (*render.Result, error) {
 		HTML:   html,
 		Etag:   data["Etag"],
 	}
+	decodeProcessed(&res, data["status"], data["headers"])
+	decodeMeta(&res, data["meta"])
 	return &res, nil
 }
 
+// Save caches a page for ttl, 0 keeps it until it is deleted
 func (c *RedisCache) Save(res *render.Result, ttl time.Duration) error {
+	key := c.key(res.URL)
 	tx := c.client.TxPipeline()
-	tx.HSet(res.URL, "Etag", res.Etag)
-	tx.HSet(res.URL, "html", res.HTML)
-	tx.PExpire(res.URL, ttl)
+	tx.HSet(key, "Etag", res.Etag)
+	tx.HSet(key, "html", res.HTML)
+	status, headers := encodeProcessed(res)
+	tx.HSet(key, "status", status)
+	tx.HSet(key, "headers", headers)
+	tx.HSet(key, "size", len(res.HTML))
+	if meta := encodeMeta(res); meta != "" {
+		tx.HSet(key, "meta", meta)
+	} else {
+		tx.HDel(key, "meta")
+	}
+	if ttl > 0 {
+		tx.PExpire(key, ttl)
+	} else {
+		// the page doesn't expire
+		tx.Persist(key)
+	}
 
 	_, err := tx.Exec()
 	return err
 }
 
+func (c *RedisCache) Get(url string) (*render.Result, *Entry, error) {
+	key := c.key(url)
+	data, err := c.client.HGetAll(key).Result()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "getting cached data failed")
+	}
+	html, ok := data["html"]
+	if !ok {
+		return nil, nil, nil
+	}
+	res := &render.Result{URL: url, Status: http.StatusOK, HTML: html, Etag: data["Etag"]}
+	decodeProcessed(res, data["status"], data["headers"])
+	decodeMeta(res, data["meta"])
+
+	entry := &Entry{URL: url, Key: key, Size: int64(len(html))}
+	if ttl, err := c.client.PTTL(key).Result(); err == nil && ttl > 0 {
+		entry.TTL = ttl
+	}
+	return res, entry, nil
+}
+
+func (c *RedisCache) Snapshot(url string) ([]byte, error) {
+	data, err := c.client.Get(c.snapshotKey(url)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, errors.Wrap(err, "getting snapshot failed")
+}
+
+func (c *RedisCache) SaveSnapshot(url string, data []byte, ttl time.Duration) error {
+	err := c.client.Set(c.snapshotKey(url), data, ttl).Err()
+	return errors.Wrap(err, "saving snapshot failed")
+}
+
+func (c *RedisCache) List(prefix string, f func(Entry) error) error {
+	pattern := c.prefix + globEscaper.Replace(prefix) + "*"
+	iter := c.client.Scan(0, pattern, 1000).Iterator()
+	for iter.Next() {
+		key := iter.Val()
+		url := strings.TrimPrefix(key, c.prefix)
+		if !isPage(url) {
+			continue
+		}
+		tx := c.client.TxPipeline()
+		size := tx.HGet(key, "size")
+		ttl := tx.PTTL(key)
+		tx.Exec()
+		if size.Err() == redis.Nil {
+			// saved before the size was, or not a page
+			if exists, err := c.client.HExists(key, "html").Result(); err != nil || !exists {
+				continue
+			}
+		}
+		entry := Entry{URL: url, Key: key}
+		entry.Size, _ = size.Int64()
+		if d := ttl.Val(); d > 0 {
+			entry.TTL = d
+		}
+		if err := f(entry); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(iter.Err(), "listing cached pages failed")
+}
+
+// globEscaper escapes the special characters of the patterns of SCAN
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (c *RedisCache) Delete(url string) error {
+	return errors.Wrap(c.client.Del(c.key(url)).Err(), "deleting cached page failed")
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
+
+func (c *RedisCache) Ping() error {
+	return errors.Wrap(c.client.Ping().Err(), "redis ping failed")
+}
+
+// WithNamespace returns a cache sharing the client whose object names
+// are prefixed with ns
+func (c *S3Cache) WithNamespace(ns string) Cache {
+	return &S3Cache{client: c.client, bucket: c.bucket, prefix: ns + "/"}
+}
+
 func (c *S3Cache) Check(r *http.Request) (*render.Result, error) {
-	url := validateUrl(r.URL.String())
+	url := validateUrl(c.prefix + r.URL.String())
 	reader, err := c.client.GetObject(c.bucket, url)
 	defer reader.Close()
 
@@ -160,6 +320,9 @@ func (c *S3Cache) Check(r *http.Request) (*render.Result, error) {
 		HTML:   html,
 		//Etag:   data["Etag"],
 	}
+	if info, err := reader.Stat(); err == nil {
+		decodeProcessed(&res, info.Metadata.Get(s3StatusKey), info.Metadata.Get(s3HeadersKey))
+	}
 
 	return &res, err
 }
@@ -167,13 +330,16 @@ func (c *S3Cache) Check(r *http.Request) (*render.Result, error) {
 func (c *S3Cache) Save(res *render.Result, ttl time.Duration) error {
 
 	reader := strings.NewReader(res.HTML)
-	url := validateUrl(res.URL)
+	url := validateUrl(c.prefix + res.URL)
 
 	metadata := map[string][]string{
 		"Content-Type": []string{"text/html"},
 		"Etag": []string{res.Etag},
 		"StorageClass": []string{"REDUCED_REDUNDANCY"},
 	}
+	status, headers := encodeProcessed(res)
+	metadata[s3StatusKey] = []string{status}
+	metadata[s3HeadersKey] = []string{headers}
 
 	n, err := c.client.PutObjectWithMetadata(c.bucket, url, reader, metadata, nil)
 	_ = n
@@ -184,6 +350,63 @@ func (c *S3Cache) Save(res *render.Result, ttl time.Duration) error {
 	return err
 }
 
+func (c *S3Cache) Get(url string) (*render.Result, *Entry, error) {
+	key := validateUrl(c.prefix + url)
+	reader, err := c.client.GetObject(c.bucket, key)
+	if err != nil {
+		return nil, nil, nil
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		// like Check, a missing object is a miss
+		return nil, nil, nil
+	}
+	buf := new(bytes.Buffer)
+	if _, err = buf.ReadFrom(reader); err != nil {
+		return nil, nil, errors.Wrap(err, "reading cached page failed")
+	}
+
+	res := &render.Result{URL: url, Status: http.StatusOK, HTML: buf.String()}
+	decodeProcessed(res, info.Metadata.Get(s3StatusKey), info.Metadata.Get(s3HeadersKey))
+	return res, &Entry{URL: url, Key: key, Size: info.Size}, nil
+}
+
+func (c *S3Cache) List(prefix string, f func(Entry) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	for object := range c.client.ListObjects(c.bucket, validateUrl(c.prefix+prefix), true, done) {
+		if object.Err != nil {
+			return errors.Wrap(object.Err, "listing cached pages failed")
+		}
+		// names longer than 1024 characters end with a hash instead of
+		// the end of the URL
+		url := strings.TrimPrefix(object.Key, c.prefix)
+		if !strings.HasPrefix(object.Key, c.prefix) || !isPage(url) {
+			continue
+		}
+		if err := f(Entry{URL: url, Key: object.Key, Size: object.Size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *S3Cache) Delete(url string) error {
+	return errors.Wrap(c.client.RemoveObject(c.bucket, validateUrl(c.prefix+url)), "deleting cached page failed")
+}
+
+func (c *S3Cache) Ping() error {
+	exists, err := c.client.BucketExists(c.bucket)
+	if err != nil {
+		return errors.Wrap(err, "checking s3 bucket failed")
+	}
+	if !exists {
+		return errors.Errorf("s3 bucket %s does not exist", c.bucket)
+	}
+	return nil
+}
+
 //Object name with non UTF-8 strings are not supported
 //Object name cannot be greater than 1024 characters
 func validateUrl(url string) (string){
@@ -207,4 +430,58 @@ func validateUrl(url string) (string){
 		url = url[0:(1024-len(sha1_hash))] + sha1_hash
 	}
 	return url
-}
\ No newline at end of file
+}
+
+// metadata keys of the status and headers set by processors on S3 objects
+const (
+	s3StatusKey  = "X-Amz-Meta-Prerender-Status"
+	s3HeadersKey = "X-Amz-Meta-Prerender-Headers"
+)
+
+// encodeProcessed serializes the status and headers processors may have
+// set on a result, so a cache hit is served like the render was
+func encodeProcessed(res *render.Result) (string, string) {
+	headers := ""
+	if len(res.Headers) > 0 {
+		data, _ := json.Marshal(res.Headers)
+		headers = string(data)
+	}
+	return strconv.Itoa(res.Status), headers
+}
+
+// decodeProcessed restores what encodeProcessed saved, entries saved
+// before it existed keep the 200 status
+func decodeProcessed(res *render.Result, status, headers string) {
+	if s, err := strconv.Atoi(status); err == nil && s != 0 {
+		res.Status = s
+	}
+	if headers != "" {
+		if err := json.Unmarshal([]byte(headers), &res.Headers); err != nil {
+			log.Printf("ignoring cached headers: %s", err)
+		}
+	}
+}
+
+// encodeMeta serializes the metadata extracted from a result. Only Redis
+// keeps it: S3 object metadata is limited to 2 KB, so results cached there
+// have their metadata extracted again from the HTML when it's needed
+func encodeMeta(res *render.Result) string {
+	if res.Meta == nil {
+		return ""
+	}
+	data, _ := json.Marshal(res.Meta)
+	return string(data)
+}
+
+// decodeMeta restores what encodeMeta saved, entries without metadata
+// leave it nil
+func decodeMeta(res *render.Result, meta string) {
+	if meta == "" {
+		return
+	}
+	res.Meta = &render.Metadata{}
+	if err := json.Unmarshal([]byte(meta), res.Meta); err != nil {
+		log.Printf("ignoring cached metadata: %s", err)
+		res.Meta = nil
+	}
+}
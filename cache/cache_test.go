@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -24,10 +25,10 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	client = NewCache(redis.NewClient(&redis.Options{
+	client = &RedisCache{client: redis.NewClient(&redis.Options{
 		Addr: s.Addr(),
 		DB:   0,
-	}))
+	})}
 	code := m.Run()
 	s.Close()
 	os.Exit(code)
@@ -36,9 +37,8 @@ func TestMain(m *testing.M) {
 func TestEtagMatch(t *testing.T) {
 	s.FlushAll()
 	s.HSet("https://netlify.com/", "Etag", "etagetag")
-	req := httptest.NewRequest("GET", "http://example.com/https://netlify.com/", nil)
-	// TODO having to do this kinda sucks
-	req.URL.Path = req.URL.Path[1:]
+	// the API replaces the URL of the request with the page's
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
 	req.Header.Add("If-None-Match", "etagetag")
 	res, err := client.Check(req)
 	require.NoError(t, err)
@@ -49,9 +49,7 @@ func TestEtagMismatch(t *testing.T) {
 	s.FlushAll()
 	s.HSet("https://netlify.com/", "Etag", "etagetag")
 	s.HSet("https://netlify.com/", "html", "<html></html>")
-	req := httptest.NewRequest("GET", "http://example.com/https://netlify.com/", nil)
-	// TODO having to do this kinda sucks
-	req.URL.Path = req.URL.Path[1:]
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
 	req.Header.Add("If-None-Match", "nottag")
 	res, err := client.Check(req)
 	require.NoError(t, err)
@@ -62,9 +60,7 @@ func TestEtagMismatch(t *testing.T) {
 
 func TestEtagNoData(t *testing.T) {
 	s.FlushAll()
-	req := httptest.NewRequest("GET", "http://example.com/https://netlify.com/", nil)
-	// TODO having to do this kinda sucks
-	req.URL.Path = req.URL.Path[1:]
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
 	req.Header.Add("If-None-Match", "etagetag")
 	res, err := client.Check(req)
 	require.NoError(t, err)
@@ -98,11 +94,111 @@ func TestSaveExpire(t *testing.T) {
 	assert.Empty(t, etag)
 }
 
+func TestNamespace(t *testing.T) {
+	s.FlushAll()
+	tenant := client.(Namespacer).WithNamespace("tenant")
+	err := tenant.Save(&render.Result{
+		URL:  "https://netlify.com/",
+		HTML: "<html></html>",
+		Etag: "etagetag",
+	}, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, "etagetag", s.HGet("tenant:https://netlify.com/", "Etag"))
+	assert.Empty(t, s.HGet("https://netlify.com/", "Etag"))
+
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
+	res, err := client.Check(req)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestSaveProcessed(t *testing.T) {
+	s.FlushAll()
+	err := client.Save(&render.Result{
+		URL:     "https://netlify.com/",
+		Status:  http.StatusNotFound,
+		HTML:    "<html></html>",
+		Etag:    "etagetag",
+		Headers: http.Header{"X-Robots-Tag": {"noindex"}},
+	}, 24*time.Hour)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
+	res, err := client.Check(req)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, http.StatusNotFound, res.Status)
+	assert.Equal(t, "noindex", res.Headers.Get("X-Robots-Tag"))
+}
+
+func TestSaveMeta(t *testing.T) {
+	s.FlushAll()
+	meta := &render.Metadata{Title: "Netlify", H1: []string{"Deploy now"}}
+	err := client.Save(&render.Result{URL: "https://netlify.com/", Status: http.StatusOK, HTML: "<html></html>", Meta: meta}, time.Hour)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
+	res, err := client.Check(req)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, meta, res.Meta)
+
+	// a new render without metadata doesn't keep the old one
+	err = client.Save(&render.Result{URL: "https://netlify.com/", Status: http.StatusOK, HTML: "<html></html>"}, time.Hour)
+	require.NoError(t, err)
+	res, _, err = client.(Manager).Get("https://netlify.com/")
+	require.NoError(t, err)
+	assert.Nil(t, res.Meta)
+}
+
+func TestManager(t *testing.T) {
+	s.FlushAll()
+	m := client.(Manager)
+	for _, url := range []string{"https://netlify.com/", "https://netlify.com/blog?a=[1]", "https://example.com/"} {
+		require.NoError(t, client.Save(&render.Result{URL: url, Status: http.StatusOK, HTML: "<html></html>"}, time.Hour))
+	}
+	require.NoError(t, client.(Namespacer).WithNamespace("tenant").Save(&render.Result{URL: "https://netlify.com/", HTML: "<p></p>"}, time.Hour))
+	s.HSet("https://old.com/", "html", "<html>before sizes</html>")
+	s.SetAdd("prerender:jobs:pending", "job")
+
+	var urls []string
+	require.NoError(t, m.List("", func(e Entry) error {
+		urls = append(urls, e.URL)
+		return nil
+	}))
+	sort.Strings(urls)
+	assert.Equal(t, []string{"https://example.com/", "https://netlify.com/", "https://netlify.com/blog?a=[1]", "https://old.com/"}, urls)
+
+	var entries []Entry
+	require.NoError(t, m.List("https://netlify.com/blog?a=[", func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	}))
+	require.Len(t, entries, 1)
+	assert.Equal(t, int64(len("<html></html>")), entries[0].Size)
+	assert.Equal(t, time.Hour, entries[0].TTL)
+
+	res, entry, err := m.Get("https://netlify.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "<html></html>", res.HTML)
+	assert.Equal(t, "https://netlify.com/", entry.Key)
+
+	require.NoError(t, m.Delete("https://netlify.com/"))
+	res, entry, err = m.Get("https://netlify.com/")
+	require.NoError(t, err)
+	assert.Nil(t, res)
+	assert.Nil(t, entry)
+	// other namespaces are untouched
+	assert.Equal(t, "<p></p>", s.HGet("tenant:https://netlify.com/", "html"))
+}
+
+func TestPing(t *testing.T) {
+	assert.NoError(t, client.(Pinger).Ping())
+}
+
 func TestCheckError(t *testing.T) {
 	s.Close()
-	req := httptest.NewRequest("GET", "http://example.com/https://netlify.com/", nil)
-	// TODO having to do this kinda sucks
-	req.URL.Path = req.URL.Path[1:]
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
 	_, err := client.Check(req)
 	assert.NotNil(t, err)
 
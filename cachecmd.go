@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+)
+
+const cacheUsage = `usage: prerender cache [-config file] [-namespace ns] <command> [flags] [args]
+
+commands:
+  get [-html] <url>        show a cached page and its metadata
+  ls [-prefix prefix]      list the cached pages
+  rm [-prefix] <url>       remove a cached page, or every page starting with the URL
+  stats                    count the cached pages and their size, by host
+  export [-prefix prefix]  write the cached pages to stdout as NDJSON
+  import [-ttl 24h] [file] save the pages of an export, read from stdin by default`
+
+// cacheCommand inspects and manages the cache of the configuration
+func cacheCommand(args []string) int {
+	flags := flag.NewFlagSet("cache", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, cacheUsage)
+	}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "configuration file")
+	namespace := flags.String("namespace", "", "cache namespace of a tenant")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	conf, err := config.Load(*configFile, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := cache.NewCache(conf.Cache)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if c == nil {
+		fmt.Fprintln(os.Stderr, "caching is disabled, set cache.backend")
+		return 1
+	}
+	if closer, ok := c.(io.Closer); ok {
+		defer closer.Close()
+	}
+	if *namespace != "" {
+		ns, ok := c.(cache.Namespacer)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "the cache backend has no namespaces")
+			return 1
+		}
+		c = ns.WithNamespace(*namespace)
+	}
+
+	if err = runCacheCommand(c, flags.Args(), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if _, ok := err.(usageError); ok {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// usageError reports invalid arguments
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// exportedPage is a line of an export
+type exportedPage struct {
+	URL     string      `json:"url"`
+	Status  int         `json:"status"`
+	Etag    string      `json:"etag,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	HTML    string      `json:"html"`
+	// TTL is the time left before the page expires, 0 when it doesn't.
+	// Imports use the -ttl flag for pages without one
+	TTL *time.Duration `json:"ttl,omitempty"`
+}
+
+// runCacheCommand runs a cache command, args starting with its name
+func runCacheCommand(c cache.Cache, args []string, stdin io.Reader, stdout io.Writer) error {
+	m, ok := c.(cache.Manager)
+	if !ok {
+		return errors.New("the cache backend can't be managed")
+	}
+	if len(args) == 0 {
+		return usageError(cacheUsage)
+	}
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	switch args[0] {
+	case "get":
+		html := flags.Bool("html", false, "show the HTML only")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return usageError("usage: prerender cache get [-html] <url>")
+		}
+		res, entry, err := m.Get(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if res == nil {
+			return errors.Errorf("%s is not cached", flags.Arg(0))
+		}
+		if *html {
+			_, err = io.WriteString(stdout, res.HTML)
+			return err
+		}
+		return writeIndented(stdout, struct {
+			*cache.Entry
+			Status  int         `json:"status"`
+			Etag    string      `json:"etag,omitempty"`
+			Headers http.Header `json:"headers,omitempty"`
+			HTML    string      `json:"html"`
+		}{entry, res.Status, res.Etag, res.Headers, res.HTML})
+
+	case "ls":
+		prefix := flags.String("prefix", "", "URL prefix")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+			return usageError("usage: prerender cache ls [-prefix prefix]")
+		}
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "URL\tSIZE\tTTL")
+		err := m.List(*prefix, func(e cache.Entry) error {
+			ttl := "-"
+			if e.TTL > 0 {
+				ttl = e.TTL.Round(time.Second).String()
+			}
+			_, err := fmt.Fprintf(w, "%s\t%d\t%s\n", e.URL, e.Size, ttl)
+			return err
+		})
+		w.Flush()
+		return err
+
+	case "rm":
+		isPrefix := flags.Bool("prefix", false, "remove every page starting with the URL")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+			return usageError("usage: prerender cache rm [-prefix] <url>")
+		}
+		if !*isPrefix {
+			res, _, err := m.Get(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			if res == nil {
+				return errors.Errorf("%s is not cached", flags.Arg(0))
+			}
+			return m.Delete(flags.Arg(0))
+		}
+		// listed first, the backends don't promise to list entries
+		// removed while listing
+		var urls []string
+		if err := m.List(flags.Arg(0), func(e cache.Entry) error {
+			urls = append(urls, e.URL)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, u := range urls {
+			if err := m.Delete(u); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(stdout, "%d pages removed\n", len(urls))
+		return nil
+
+	case "stats":
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+			return usageError("usage: prerender cache stats")
+		}
+		type hostStats struct {
+			Host  string `json:"host"`
+			Pages int    `json:"pages"`
+			Size  int64  `json:"size"`
+		}
+		total := hostStats{Host: "total"}
+		hosts := map[string]*hostStats{}
+		if err := m.List("", func(e cache.Entry) error {
+			host := ""
+			if u, err := url.Parse(e.URL); err == nil {
+				host = u.Host
+			}
+			if hosts[host] == nil {
+				hosts[host] = &hostStats{Host: host}
+			}
+			hosts[host].Pages++
+			hosts[host].Size += e.Size
+			total.Pages++
+			total.Size += e.Size
+			return nil
+		}); err != nil {
+			return err
+		}
+		sorted := make([]*hostStats, 0, len(hosts))
+		for _, h := range hosts {
+			sorted = append(sorted, h)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].Pages != sorted[j].Pages {
+				return sorted[i].Pages > sorted[j].Pages
+			}
+			return sorted[i].Host < sorted[j].Host
+		})
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tPAGES\tSIZE")
+		for _, h := range append(sorted, &total) {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", h.Host, h.Pages, h.Size)
+		}
+		return w.Flush()
+
+	case "export":
+		prefix := flags.String("prefix", "", "URL prefix")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+			return usageError("usage: prerender cache export [-prefix prefix]")
+		}
+		enc := json.NewEncoder(stdout)
+		return m.List(*prefix, func(e cache.Entry) error {
+			res, entry, err := m.Get(e.URL)
+			if err != nil || res == nil {
+				// expired since it was listed
+				return err
+			}
+			return enc.Encode(exportedPage{
+				URL:     res.URL,
+				Status:  res.Status,
+				Etag:    res.Etag,
+				Headers: res.Headers,
+				HTML:    res.HTML,
+				TTL:     &entry.TTL,
+			})
+		})
+
+	case "import":
+		ttl := flags.Duration("ttl", 24*time.Hour, "expiration of the pages exported without one")
+		if err := flags.Parse(args[1:]); err != nil || flags.NArg() > 1 {
+			return usageError("usage: prerender cache import [-ttl 24h] [file]")
+		}
+		in := stdin
+		if flags.NArg() == 1 {
+			f, err := os.Open(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		scanner := bufio.NewScanner(in)
+		// pages are often larger than the default token size
+		scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		n := 0
+		for line := 1; scanner.Scan(); line++ {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var page exportedPage
+			if err := json.Unmarshal(scanner.Bytes(), &page); err != nil {
+				return errors.Wrapf(err, "line %d", line)
+			}
+			if page.URL == "" {
+				return errors.Errorf("line %d: url is required", line)
+			}
+			expiration := *ttl
+			if page.TTL != nil {
+				expiration = *page.TTL
+			}
+			res := &render.Result{URL: page.URL, Status: page.Status, Etag: page.Etag, Headers: page.Headers, HTML: page.HTML}
+			if res.Status == 0 {
+				res.Status = http.StatusOK
+			}
+			res.Meta = render.ExtractMetadata(res.HTML)
+			if err := c.Save(res, expiration); err != nil {
+				return errors.Wrapf(err, "saving %s failed", page.URL)
+			}
+			n++
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%d pages imported\n", n)
+		return nil
+	}
+	return usageError(cacheUsage)
+}
+
+func writeIndented(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
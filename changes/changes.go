@@ -0,0 +1,352 @@
+// Package changes detects when the content of a page changes from one
+// render to the next, and posts the changes to a webhook
+package changes
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/jsonld"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// maxDiffLines bounds the lines listed in a diff, maxLineLength
+	// truncates them
+	maxDiffLines  = 20
+	maxLineLength = 300
+)
+
+// SnapshotTTL is how long the snapshot of a page is kept after its last
+// render, much longer than the page is cached so that renders days apart
+// are still compared
+const SnapshotTTL = 30 * 24 * time.Hour
+
+// Change is the event posted when the content of a page changed
+type Change struct {
+	Event  string `json:"event"`
+	URL    string `json:"url"`
+	Tenant string `json:"tenant,omitempty"`
+	// OldHash and NewHash are the MD5 of the normalized contents
+	OldHash string `json:"oldHash"`
+	NewHash string `json:"newHash"`
+	// OldEtag and NewEtag are the Etags of the renders, which also change
+	// with the volatile elements
+	OldEtag    string    `json:"oldEtag,omitempty"`
+	NewEtag    string    `json:"newEtag,omitempty"`
+	Diff       Diff      `json:"diff"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// Snapshot is what is kept of a render to compare the next one with
+type Snapshot struct {
+	Etag    string   `json:"etag,omitempty"`
+	Hash    string   `json:"hash"`
+	Content []string `json:"content"`
+}
+
+// Diff summarizes the lines of content added and removed. Lines are the
+// text of the blocks of the page, its title, meta tags, canonical link and
+// JSON-LD scripts, and its status
+type Diff struct {
+	Summary      string   `json:"summary"`
+	AddedCount   int      `json:"addedCount"`
+	RemovedCount int      `json:"removedCount"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+}
+
+// Detector compares the renders of pages with their previous version
+type Detector struct {
+	webhook string
+	client  *http.Client
+	// ignore select the volatile elements left out of the comparison
+	ignore []*process.Selector
+	// pending counts the changes being posted
+	pending sync.WaitGroup
+}
+
+// New creates the detector configured by c, or returns nil when c has no
+// webhook
+func New(c config.Changes) (*Detector, error) {
+	if c.Webhook == "" {
+		return nil, nil
+	}
+	d := &Detector{
+		webhook: c.Webhook,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, s := range c.Ignore {
+		sel, err := process.ParseSelector(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "changes.ignore")
+		}
+		d.ignore = append(d.ignore, sel)
+	}
+	return d, nil
+}
+
+// Snapshot returns the snapshot of a result
+func (d *Detector) Snapshot(res *render.Result) (*Snapshot, error) {
+	content, err := d.Content(res)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Etag: res.Etag, Hash: hash(content), Content: content}, nil
+}
+
+// Compare returns the change from the snapshot of the previous render of
+// a page to its new result, or nil when there is no previous snapshot or
+// their normalized content is the same. It also returns the snapshot of
+// the new result, to compare the next render with
+func (d *Detector) Compare(old *Snapshot, new *render.Result) (*Change, *Snapshot, error) {
+	snap, err := d.Snapshot(new)
+	if err != nil {
+		return nil, nil, err
+	}
+	if old == nil || old.Hash == snap.Hash {
+		return nil, snap, nil
+	}
+	return &Change{
+		Event:      "content.changed",
+		URL:        new.URL,
+		OldHash:    old.Hash,
+		NewHash:    snap.Hash,
+		OldEtag:    old.Etag,
+		NewEtag:    snap.Etag,
+		Diff:       diff(old.Content, snap.Content),
+		DetectedAt: time.Now().UTC(),
+	}, snap, nil
+}
+
+// Content returns the normalized content of a result, as lines: what
+// crawlers see of the page without the ignored elements, the scripts and
+// the styles
+func (d *Detector) Content(res *render.Result) ([]string, error) {
+	doc, err := html.Parse(strings.NewReader(res.HTML))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing html failed")
+	}
+	lines := []string{fmt.Sprintf("status: %d", res.Status)}
+	var text bytes.Buffer
+	flush := func() {
+		if line := collapse(text.String()); line != "" {
+			lines = append(lines, line)
+		}
+		text.Reset()
+	}
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			text.WriteString(n.Data)
+			return
+		case html.ElementNode:
+			for _, sel := range d.ignore {
+				if sel.Match(n) {
+					return
+				}
+			}
+			if line := metadata(n); line != "" {
+				flush()
+				lines = append(lines, line)
+				return
+			}
+			switch n.DataAtom {
+			case atom.Title, atom.Script, atom.Style, atom.Noscript, atom.Template, atom.Meta, atom.Link:
+				return
+			}
+			if blocks[n.DataAtom] {
+				flush()
+				defer flush()
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			visit(c)
+		}
+	}
+	visit(doc)
+	flush()
+	return lines, nil
+}
+
+// metadata returns the line of content of the elements crawlers read
+// besides the text: title, meta tags, canonical link and JSON-LD
+func metadata(n *html.Node) string {
+	switch n.DataAtom {
+	case atom.Title:
+		return "title: " + collapse(textContent(n))
+	case atom.Meta:
+		name := strings.ToLower(attr(n, "name"))
+		if name == "" {
+			name = strings.ToLower(attr(n, "property"))
+		}
+		if name == "description" || name == "robots" || strings.HasPrefix(name, "og:") || strings.HasPrefix(name, "twitter:") {
+			return "meta " + name + ": " + collapse(attr(n, "content"))
+		}
+	case atom.Link:
+		rel := attr(n, "rel")
+		if render.HasRel(rel, "canonical") {
+			return "canonical: " + attr(n, "href")
+		}
+		if render.HasRel(rel, "alternate") && attr(n, "hreflang") != "" {
+			return "alternate " + attr(n, "hreflang") + ": " + attr(n, "href")
+		}
+	case atom.Script:
+		if jsonld.IsType(attr(n, "type")) {
+			data := textContent(n)
+			var compact bytes.Buffer
+			if json.Compact(&compact, []byte(data)) == nil {
+				data = compact.String()
+			}
+			return "json-ld: " + collapse(data)
+		}
+	}
+	return ""
+}
+
+// blocks are the elements which start a new line of text
+var blocks = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true,
+	atom.Br: true, atom.Button: true, atom.Caption: true, atom.Dd: true,
+	atom.Details: true, atom.Dialog: true, atom.Div: true, atom.Dl: true,
+	atom.Dt: true, atom.Fieldset: true, atom.Figcaption: true, atom.Figure: true,
+	atom.Footer: true, atom.Form: true, atom.H1: true, atom.H2: true,
+	atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Header: true, atom.Hr: true, atom.Li: true, atom.Main: true,
+	atom.Nav: true, atom.Ol: true, atom.Option: true, atom.P: true,
+	atom.Pre: true, atom.Section: true, atom.Summary: true, atom.Table: true,
+	atom.Td: true, atom.Th: true, atom.Tr: true, atom.Ul: true,
+}
+
+// Notify posts the change to the webhook in the background
+func (d *Detector) Notify(c *Change) {
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+		if err := d.post(c); err != nil {
+			log.Printf("error posting content change: %s : %s", err, c.URL)
+		}
+	}()
+}
+
+func (d *Detector) post(c *Change) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "posting to webhook failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Drain waits for the changes being posted, until ctx is done
+func (d *Detector) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func hash(lines []string) string {
+	sum := md5.Sum([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// diff lists the lines of new which aren't in old and the other way
+// around, ignoring the lines which only moved
+func diff(old, new []string) Diff {
+	remaining := map[string]int{}
+	for _, line := range old {
+		remaining[line]++
+	}
+	var d Diff
+	for _, line := range new {
+		if remaining[line] > 0 {
+			remaining[line]--
+			continue
+		}
+		d.AddedCount++
+		if len(d.Added) < maxDiffLines {
+			d.Added = append(d.Added, truncate(line))
+		}
+	}
+	for _, line := range old {
+		if remaining[line] == 0 {
+			continue
+		}
+		remaining[line]--
+		d.RemovedCount++
+		if len(d.Removed) < maxDiffLines {
+			d.Removed = append(d.Removed, truncate(line))
+		}
+	}
+	d.Summary = fmt.Sprintf("%d added, %d removed", d.AddedCount, d.RemovedCount)
+	if d.AddedCount+d.RemovedCount == 0 {
+		d.Summary = "lines reordered"
+	}
+	return d
+}
+
+func textContent(n *html.Node) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			buf.WriteString(c.Data)
+		}
+	}
+	return buf.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// collapse trims s and collapses its runs of whitespace to single spaces
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncate(s string) string {
+	if len(s) <= maxLineLength {
+		return s
+	}
+	end := maxLineLength
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "…"
+}
@@ -0,0 +1,125 @@
+package changes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/render"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const page = `<html><head><title>Shoes</title><meta name="description" content="Red shoes">
+<link rel="canonical" href="https://example.com/shoes"><script>app()</script>
+<script type="application/ld+json">{ "@type": "Product",
+  "name": "Shoes" }</script></head>
+<body><div class="clock">12:00:01</div><h1>Red   <b>shoes</b></h1><p>Size 42</p><ul><li>Leather</li><li>Rubber</li></ul></body></html>`
+
+func TestNew(t *testing.T) {
+	d, err := New(config.Changes{})
+	require.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = New(config.Changes{Webhook: "https://hooks.example.com/", Ignore: []string{"a:hover"}})
+	assert.Error(t, err)
+}
+
+func TestContent(t *testing.T) {
+	d, err := New(config.Changes{Webhook: "https://hooks.example.com/", Ignore: []string{".clock"}})
+	require.NoError(t, err)
+	content, err := d.Content(&render.Result{Status: http.StatusOK, HTML: page})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"status: 200",
+		"title: Shoes",
+		"meta description: Red shoes",
+		"canonical: https://example.com/shoes",
+		`json-ld: {"@type":"Product","name":"Shoes"}`,
+		"Red shoes",
+		"Size 42",
+		"Leather",
+		"Rubber",
+	}, content)
+}
+
+func TestContentRel(t *testing.T) {
+	d, err := New(config.Changes{Webhook: "https://hooks.example.com/"})
+	require.NoError(t, err)
+	content, err := d.Content(&render.Result{Status: http.StatusOK, HTML: `<html><head>
+<link rel="canonical nofollow" href="https://example.com/shoes">
+<link rel="Alternate" hreflang="de" href="https://example.com/de/shoes">
+<link rel="stylesheet" href="/shoes.css"></head></html>`})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"status: 200",
+		"canonical: https://example.com/shoes",
+		"alternate de: https://example.com/de/shoes",
+	}, content)
+}
+
+func TestCompare(t *testing.T) {
+	d, err := New(config.Changes{Webhook: "https://hooks.example.com/", Ignore: []string{".clock"}})
+	require.NoError(t, err)
+	url := "https://example.com/shoes"
+
+	// nothing to compare the first render with
+	change, old, err := d.Compare(nil, &render.Result{URL: url, Status: http.StatusOK, HTML: page, Etag: "etag1"})
+	require.NoError(t, err)
+	assert.Nil(t, change)
+	require.NotNil(t, old)
+	assert.Equal(t, "etag1", old.Etag)
+	assert.Len(t, old.Content, 9)
+
+	// volatile elements and markup don't count
+	same := strings.Replace(page, "12:00:01", "12:00:02", 1)
+	same = strings.Replace(same, "<p>Size 42</p>", "<p class=\"size\">\n  Size 42\n</p>", 1)
+	change, snap, err := d.Compare(old, &render.Result{URL: url, Status: http.StatusOK, HTML: same, Etag: "etag2"})
+	require.NoError(t, err)
+	assert.Nil(t, change)
+	assert.Equal(t, old.Hash, snap.Hash)
+	assert.Equal(t, "etag2", snap.Etag)
+
+	lost := strings.Replace(page, "<title>Shoes</title>", "", 1)
+	lost = strings.Replace(lost, "<li>Rubber</li>", "<li>Canvas</li>", 1)
+	change, snap, err = d.Compare(old, &render.Result{URL: url, Status: http.StatusOK, HTML: lost, Etag: "etag3"})
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	assert.Equal(t, "content.changed", change.Event)
+	assert.Equal(t, "https://example.com/shoes", change.URL)
+	assert.Equal(t, old.Hash, change.OldHash)
+	assert.Equal(t, snap.Hash, change.NewHash)
+	assert.NotEqual(t, change.OldHash, change.NewHash)
+	assert.Equal(t, "etag1", change.OldEtag)
+	assert.Equal(t, "etag3", change.NewEtag)
+	assert.Equal(t, Diff{
+		Summary:      "1 added, 2 removed",
+		AddedCount:   1,
+		RemovedCount: 2,
+		Added:        []string{"Canvas"},
+		Removed:      []string{"title: Shoes", "Rubber"},
+	}, change.Diff)
+}
+
+func TestNotify(t *testing.T) {
+	posted := make(chan Change, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c Change
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&c))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		posted <- c
+	}))
+	defer server.Close()
+
+	d, err := New(config.Changes{Webhook: server.URL})
+	require.NoError(t, err)
+	d.Notify(&Change{Event: "content.changed", URL: "https://example.com/", OldHash: "a", NewHash: "b"})
+	require.NoError(t, d.Drain(context.Background()))
+	c := <-posted
+	assert.Equal(t, "https://example.com/", c.URL)
+	assert.Equal(t, "b", c.NewHash)
+}
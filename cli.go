@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+)
+
+// commands are the subcommands of the binary, which runs the server when
+// there is none
+var commands = map[string]func(args []string) int{
+	"render": renderCommand,
+	"cache":  cacheCommand,
+}
+
+// renderCommand renders a single page to stdout, with the configuration,
+// guard and processors of the server but without the cache
+func renderCommand(args []string) int {
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: prerender render [flags] <url>")
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "configuration file")
+	format := flags.String("format", formatHTML, "output format, html, json, har, meta or jsonld")
+	wait := flags.String("wait", "", "extra time to wait once the page looks done")
+	timeout := flags.String("timeout", "", "page load timeout")
+	userAgent := flags.String("user-agent", "", "User-Agent sent to the origin, e.g. the one of Googlebot")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	opts, err := parseOptions(func(name string) string {
+		switch name {
+		case "url":
+			return flags.Arg(0)
+		case "format":
+			return *format
+		case "wait":
+			return *wait
+		case "timeout":
+			return *timeout
+		case "userAgent":
+			return *userAgent
+		}
+		return ""
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	conf, err := config.Load(*configFile, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	policy, err := guard.NewPolicy(conf.Guard)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	pipeline, err := process.NewPipeline(conf.ProcessorSteps())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	renderer, err := render.NewRenderer(conf.Render, policy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer renderer.Close()
+
+	a := &app{config: conf, pipeline: pipeline, renderer: renderer, policy: policy}
+	if err = a.renderTo(os.Stdout, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// renderTo renders the page of opts and writes it to w. Pages that don't
+// render with a 2xx or 3xx status are written too, and fail
+func (a *app) renderTo(w io.Writer, opts *renderOptions) error {
+	req, err := http.NewRequest(http.MethodGet, opts.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(setOptions(a.context(req.Context()), opts))
+
+	res, err := getData(req)
+	if err != nil {
+		return errors.Wrap(err, "rendering failed")
+	}
+	if opts.Format == formatHAR {
+		if err = writeIndented(w, res.HAR); err != nil {
+			return err
+		}
+	} else if opts.Format == formatJSONLD {
+		report := structuredData(res)
+		if err = writeIndented(w, report); err != nil {
+			return err
+		}
+		if !report.Valid {
+			return errors.Errorf("structured data has %d errors", report.Errors)
+		}
+	} else if opts.Format == formatMeta {
+		if err = writeIndented(w, pageMeta(res)); err != nil {
+			return err
+		}
+	} else if opts.Format == formatJSON {
+		withMeta(res)
+		if err = writeIndented(w, res); err != nil {
+			return err
+		}
+	} else {
+		io.WriteString(w, res.HTML)
+	}
+	if res.Status >= http.StatusBadRequest {
+		return errors.Errorf("page responded %d", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,496 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mixelito/prerender/ratelimit"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of the service, read from a YAML file and
+// overridden by environment variables
+type Config struct {
+	Port        string     `yaml:"port" json:"port"`
+	TenantsFile string     `yaml:"tenantsFile" json:"tenantsFile"`
+	AdminToken  string     `yaml:"adminToken" json:"adminToken"`
+	Render      Render     `yaml:"render" json:"render"`
+	Cache       Cache      `yaml:"cache" json:"cache"`
+	Jobs        Jobs       `yaml:"jobs" json:"jobs"`
+	Batch       Batch      `yaml:"batch" json:"batch"`
+	Guard       Guard      `yaml:"guard" json:"guard"`
+	RateLimits  RateLimits `yaml:"rateLimits" json:"rateLimits"`
+	Plugins     Plugins    `yaml:"plugins" json:"plugins"`
+	// Processors replace the pipeline built from Plugins when set
+	Processors []Processor `yaml:"processors" json:"processors,omitempty"`
+	Shutdown   Shutdown    `yaml:"shutdown" json:"shutdown"`
+	Proxy      Proxy       `yaml:"proxy" json:"proxy"`
+	Changes    Changes     `yaml:"changes" json:"changes"`
+}
+
+// Render configures Chrome
+type Render struct {
+	ChromePath string   `yaml:"chromePath" json:"chromePath"`
+	Timeout    Duration `yaml:"timeout" json:"timeout"`
+	MaxTabs    int      `yaml:"maxTabs" json:"maxTabs"`
+	// DebugPort is the DevTools port of Chrome, 0 picks a free one
+	DebugPort int `yaml:"debugPort" json:"debugPort"`
+}
+
+// Cache configures where rendered pages are cached. Backend is redis, s3
+// or empty to disable caching
+type Cache struct {
+	Backend  string `yaml:"backend" json:"backend"`
+	RedisURL string `yaml:"redisURL" json:"redisURL"`
+	S3       S3     `yaml:"s3" json:"s3"`
+}
+
+// S3 holds the credentials and bucket of the S3 cache
+type S3 struct {
+	AccessKey string `yaml:"accessKey" json:"accessKey"`
+	SecretKey string `yaml:"secretKey" json:"secretKey"`
+	Bucket    string `yaml:"bucket" json:"bucket"`
+	Region    string `yaml:"region" json:"region"`
+}
+
+// Jobs configures background jobs. They are stored in the Redis cache
+// when there is one, otherwise in Dir
+type Jobs struct {
+	Dir     string `yaml:"dir" json:"dir"`
+	Workers int    `yaml:"workers" json:"workers"`
+}
+
+// Batch configures POST /render/batch
+type Batch struct {
+	MaxURLs     int `yaml:"maxURLs" json:"maxURLs"`
+	Concurrency int `yaml:"concurrency" json:"concurrency"`
+}
+
+// Guard configures the URLs that may be rendered
+type Guard struct {
+	AllowedHosts    []string `yaml:"allowedHosts" json:"allowedHosts"`
+	AllowedSchemes  []string `yaml:"allowedSchemes" json:"allowedSchemes"`
+	AllowPrivateIPs bool     `yaml:"allowPrivateIPs" json:"allowPrivateIPs"`
+	// DeniedNetworks are CIDRs denied on top of guard.DeniedNetworks
+	DeniedNetworks []string `yaml:"deniedNetworks" json:"deniedNetworks"`
+}
+
+// RateLimits configures the rate limits, written like "10/s" or
+// "100/1m,20". Store is memory or redis
+type RateLimits struct {
+	Client string `yaml:"client" json:"client"`
+	Origin string `yaml:"origin" json:"origin"`
+	Store  string `yaml:"store" json:"store"`
+}
+
+// Plugins enables the processing of the rendered HTML
+type Plugins struct {
+	StatusCode bool `yaml:"statusCode" json:"statusCode"`
+	ScriptTags bool `yaml:"scriptTags" json:"scriptTags"`
+}
+
+// Processor enables a processor of the HTML pipeline, only on the pages
+// of Hosts when set
+type Processor struct {
+	Name    string            `yaml:"name" json:"name"`
+	Hosts   []string          `yaml:"hosts" json:"hosts,omitempty"`
+	Options map[string]string `yaml:"options" json:"options,omitempty"`
+}
+
+// Shutdown configures the draining of the service on SIGTERM
+type Shutdown struct {
+	Delay   Duration `yaml:"delay" json:"delay"`
+	Timeout Duration `yaml:"timeout" json:"timeout"`
+}
+
+// Proxy runs the service as a reverse proxy in front of Upstream, the
+// origin of the site, when it is set: crawlers get rendered pages and
+// every other request is proxied
+type Proxy struct {
+	Upstream string `yaml:"upstream" json:"upstream"`
+	// CrawlerUserAgents replace middleware.CrawlerUserAgents when set
+	CrawlerUserAgents []string `yaml:"crawlerUserAgents" json:"crawlerUserAgents,omitempty"`
+	// Scheme of the rendered URLs, defaults to the one of the requests
+	Scheme string `yaml:"scheme" json:"scheme"`
+	// Hosts are the hosts rendered besides the one of Upstream, as exact
+	// names or patterns like *.example.com
+	Hosts []string `yaml:"hosts" json:"hosts,omitempty"`
+}
+
+// Changes posts to Webhook the pages which render with a content other
+// than the one of their cached version. Ignore lists the CSS selectors of
+// the volatile elements left out of the comparison, like dates or ads
+type Changes struct {
+	Webhook string   `yaml:"webhook" json:"webhook"`
+	Ignore  []string `yaml:"ignore" json:"ignore,omitempty"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Port: "8000",
+		Render: Render{
+			ChromePath: "/Applications/Google Chrome Canary.app/Contents/MacOS/Google Chrome Canary",
+			Timeout:    Duration(20 * time.Second),
+			MaxTabs:    10,
+		},
+		Cache: Cache{
+			RedisURL: "redis://localhost:6379/0",
+			S3:       S3{Region: "us-east-1"},
+		},
+		Jobs: Jobs{Workers: 2},
+		Batch: Batch{
+			MaxURLs:     100,
+			Concurrency: 5,
+		},
+		Guard: Guard{
+			AllowedSchemes: []string{"http", "https"},
+		},
+		RateLimits: RateLimits{Store: "memory"},
+		Plugins: Plugins{
+			StatusCode: true,
+			ScriptTags: true,
+		},
+		Shutdown: Shutdown{Timeout: Duration(30 * time.Second)},
+	}
+}
+
+// Load reads the configuration file at path, if any, applies the
+// environment variables read by getenv and validates the result
+func Load(path string, getenv func(string) string) (*Config, error) {
+	c := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading config failed")
+		}
+		// strict so a misspelled key isn't silently ignored
+		if err = yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, errors.Wrap(err, "decoding config failed")
+		}
+	}
+	if err := c.applyEnv(getenv); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e, "; ")
+}
+
+// applyEnv overrides the configuration with the environment variables
+// that are set
+func (c *Config) applyEnv(getenv func(string) string) error {
+	var errs ValidationError
+	str := func(name string, dst *string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v := getenv(name); v != "" {
+			*dst = splitList(v)
+		}
+	}
+	num := func(name string, dst *int) {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not a number", name, v))
+			}
+			*dst = n
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %q is not true or false", name, v))
+			}
+			*dst = b
+		}
+	}
+	duration := func(name string, dst *Duration) {
+		if v := getenv(name); v != "" {
+			d, err := ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			}
+			*dst = Duration(d)
+		}
+	}
+
+	str("PORT", &c.Port)
+	str("TENANTS_FILE", &c.TenantsFile)
+	str("ADMIN_TOKEN", &c.AdminToken)
+
+	str("CHROME_PATH", &c.Render.ChromePath)
+	duration("PAGE_LOAD_TIMEOUT", &c.Render.Timeout)
+	// RENDER_TIMEOUT used to be applied after PAGE_LOAD_TIMEOUT
+	duration("RENDER_TIMEOUT", &c.Render.Timeout)
+	num("MAX_TABS", &c.Render.MaxTabs)
+	num("CHROME_DEBUG_PORT", &c.Render.DebugPort)
+
+	str("CACHE", &c.Cache.Backend)
+	str("REDIS_URL", &c.Cache.RedisURL)
+	str("AWS_ACCESS_KEY_ID", &c.Cache.S3.AccessKey)
+	str("AWS_SECRET_ACCESS_KEY", &c.Cache.S3.SecretKey)
+	str("AWS_S3_BUCKET_NAME", &c.Cache.S3.Bucket)
+	str("AWS_REGION", &c.Cache.S3.Region)
+
+	str("JOBS_DIR", &c.Jobs.Dir)
+	num("JOB_WORKERS", &c.Jobs.Workers)
+
+	num("BATCH_MAX_URLS", &c.Batch.MaxURLs)
+	num("BATCH_CONCURRENCY", &c.Batch.Concurrency)
+
+	list("ALLOWED_HOSTS", &c.Guard.AllowedHosts)
+	list("ALLOWED_SCHEMES", &c.Guard.AllowedSchemes)
+	boolean("ALLOW_PRIVATE_IPS", &c.Guard.AllowPrivateIPs)
+	list("DENIED_NETWORKS", &c.Guard.DeniedNetworks)
+
+	str("CLIENT_RATE_LIMIT", &c.RateLimits.Client)
+	str("ORIGIN_RATE_LIMIT", &c.RateLimits.Origin)
+	str("RATE_LIMIT_STORE", &c.RateLimits.Store)
+
+	boolean("PLUGIN_STATUS_CODE", &c.Plugins.StatusCode)
+	boolean("PLUGIN_SCRIPT_TAGS", &c.Plugins.ScriptTags)
+
+	duration("SHUTDOWN_DELAY", &c.Shutdown.Delay)
+	duration("SHUTDOWN_TIMEOUT", &c.Shutdown.Timeout)
+
+	str("PROXY_UPSTREAM", &c.Proxy.Upstream)
+	list("PROXY_CRAWLER_USER_AGENTS", &c.Proxy.CrawlerUserAgents)
+	str("PROXY_SCHEME", &c.Proxy.Scheme)
+	list("PROXY_HOSTS", &c.Proxy.Hosts)
+
+	str("CHANGES_WEBHOOK", &c.Changes.Webhook)
+	list("CHANGES_IGNORE", &c.Changes.Ignore)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ProcessorSteps returns the processors of the pipeline, which default to
+// the built-in processors enabled by Plugins
+func (c *Config) ProcessorSteps() []Processor {
+	if len(c.Processors) > 0 {
+		return c.Processors
+	}
+	var steps []Processor
+	if c.Plugins.StatusCode {
+		steps = append(steps, Processor{Name: "statusCode"})
+	}
+	if c.Plugins.ScriptTags {
+		steps = append(steps, Processor{Name: "stripScripts"})
+	}
+	return steps
+}
+
+// Validate checks the values of the configuration, reporting every
+// problem at once
+func (c *Config) Validate() error {
+	var errs ValidationError
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		fail("port: %q is not a valid port", c.Port)
+	}
+
+	if c.Render.ChromePath == "" {
+		fail("render.chromePath: must be set")
+	}
+	if c.Render.Timeout <= 0 {
+		fail("render.timeout: must be positive")
+	}
+	if c.Render.MaxTabs <= 0 {
+		fail("render.maxTabs: must be positive")
+	}
+	if c.Render.DebugPort < 0 || c.Render.DebugPort > 65535 {
+		fail("render.debugPort: %d is not a valid port", c.Render.DebugPort)
+	}
+
+	switch c.Cache.Backend {
+	case "":
+	case "redis":
+		if err := checkRedisURL(c.Cache.RedisURL); err != nil {
+			fail("cache.redisURL: %s", err)
+		}
+	case "s3":
+		if c.Cache.S3.Bucket == "" {
+			fail("cache.s3.bucket: must be set with the s3 backend")
+		}
+	default:
+		fail("cache.backend: %q is not redis, s3 or empty", c.Cache.Backend)
+	}
+
+	if c.Jobs.Workers <= 0 {
+		fail("jobs.workers: must be positive")
+	}
+	if c.Batch.MaxURLs <= 0 {
+		fail("batch.maxURLs: must be positive")
+	}
+	if c.Batch.Concurrency <= 0 {
+		fail("batch.concurrency: must be positive")
+	}
+
+	if len(c.Guard.AllowedSchemes) == 0 {
+		fail("guard.allowedSchemes: must not be empty")
+	}
+
+	if _, err := ratelimit.ParseLimit(c.RateLimits.Client); err != nil {
+		fail("rateLimits.client: %s", err)
+	}
+	if _, err := ratelimit.ParseLimit(c.RateLimits.Origin); err != nil {
+		fail("rateLimits.origin: %s", err)
+	}
+	switch c.RateLimits.Store {
+	case "memory":
+	case "redis":
+		if err := checkRedisURL(c.Cache.RedisURL); err != nil {
+			fail("cache.redisURL: %s", err)
+		}
+	default:
+		fail("rateLimits.store: %q is not memory or redis", c.RateLimits.Store)
+	}
+
+	for i, p := range c.Processors {
+		if p.Name == "" {
+			fail("processors[%d].name: must be set", i)
+		}
+	}
+
+	if c.Shutdown.Delay < 0 {
+		fail("shutdown.delay: must not be negative")
+	}
+	if c.Shutdown.Timeout < 0 {
+		fail("shutdown.timeout: must not be negative")
+	}
+
+	if c.Proxy.Upstream != "" {
+		if u, err := url.Parse(c.Proxy.Upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("proxy.upstream: %q is not a http or https URL", c.Proxy.Upstream)
+		}
+	}
+	if c.Proxy.Scheme != "" && c.Proxy.Scheme != "http" && c.Proxy.Scheme != "https" {
+		fail("proxy.scheme: %q is not http, https or empty", c.Proxy.Scheme)
+	}
+	for _, host := range c.Proxy.Hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			fail("proxy.hosts: %q is not a valid pattern", host)
+		}
+	}
+
+	if c.Changes.Webhook != "" {
+		if u, err := url.Parse(c.Changes.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("changes.webhook: %q is not a http or https URL", c.Changes.Webhook)
+		}
+		if c.Cache.Backend == "" {
+			fail("changes.webhook: pages are compared with their cached version, set cache.backend")
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkRedisURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return errors.Errorf("%q is not a redis:// URL", s)
+	}
+	return nil
+}
+
+const redacted = "REDACTED"
+
+// Redacted returns a copy of the configuration safe to display, without
+// secrets
+func (c *Config) Redacted() *Config {
+	r := *c
+	if r.AdminToken != "" {
+		r.AdminToken = redacted
+	}
+	if r.Cache.S3.SecretKey != "" {
+		r.Cache.S3.SecretKey = redacted
+	}
+	if u, err := url.Parse(r.Cache.RedisURL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			r.Cache.RedisURL = u.String()
+		}
+	}
+	return &r
+}
+
+// Duration is a time.Duration written as a time.ParseDuration string or
+// a number of milliseconds
+type Duration time.Duration
+
+// ParseDuration accepts a time.ParseDuration string or a number of
+// milliseconds
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if ms, err := strconv.Atoi(s); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.Errorf("%q is not a duration like 20s or a number of milliseconds", s)
+	}
+	if d < 0 {
+		return 0, errors.Errorf("%q is negative", s)
+	}
+	return d, nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
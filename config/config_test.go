@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func env(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "prerender-config")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestDefault(t *testing.T) {
+	c, err := Load("", env(nil))
+	require.NoError(t, err)
+	assert.Equal(t, Default(), c)
+	assert.Equal(t, 20*time.Second, time.Duration(c.Render.Timeout))
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+port: "9000"
+render:
+  timeout: 30s
+  maxTabs: 4
+cache:
+  backend: redis
+  redisURL: redis://redis:6379/1
+guard:
+  allowedHosts: ["*.example.com"]
+shutdown:
+  delay: 5000
+`)
+	defer os.Remove(path)
+
+	c, err := Load(path, env(map[string]string{"MAX_TABS": "8"}))
+	require.NoError(t, err)
+	assert.Equal(t, "9000", c.Port)
+	assert.Equal(t, 30*time.Second, time.Duration(c.Render.Timeout))
+	// the environment overrides the file
+	assert.Equal(t, 8, c.Render.MaxTabs)
+	assert.Equal(t, "redis", c.Cache.Backend)
+	assert.Equal(t, []string{"*.example.com"}, c.Guard.AllowedHosts)
+	assert.Equal(t, 5*time.Second, time.Duration(c.Shutdown.Delay))
+	// untouched sections keep their defaults
+	assert.Equal(t, 100, c.Batch.MaxURLs)
+}
+
+func TestLoadFileUnknownKey(t *testing.T) {
+	path := writeConfig(t, "render:\n  timout: 30s\n")
+	defer os.Remove(path)
+
+	_, err := Load(path, env(nil))
+	assert.Error(t, err)
+}
+
+func TestEnv(t *testing.T) {
+	c, err := Load("", env(map[string]string{
+		"PAGE_LOAD_TIMEOUT":  "15000",
+		"ALLOWED_HOSTS":      "example.com, *.example.org",
+		"ALLOW_PRIVATE_IPS":  "true",
+		"PLUGIN_SCRIPT_TAGS": "false",
+		"CACHE":              "s3",
+		"AWS_S3_BUCKET_NAME": "pages",
+		"CHANGES_WEBHOOK":    "https://hooks.example.com/changes",
+		"CHANGES_IGNORE":     ".clock, #ads",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 15*time.Second, time.Duration(c.Render.Timeout))
+	assert.Equal(t, []string{"example.com", "*.example.org"}, c.Guard.AllowedHosts)
+	assert.True(t, c.Guard.AllowPrivateIPs)
+	assert.True(t, c.Plugins.StatusCode)
+	assert.False(t, c.Plugins.ScriptTags)
+	assert.Equal(t, "pages", c.Cache.S3.Bucket)
+	assert.Equal(t, "https://hooks.example.com/changes", c.Changes.Webhook)
+	assert.Equal(t, []string{".clock", "#ads"}, c.Changes.Ignore)
+
+	// RENDER_TIMEOUT wins over PAGE_LOAD_TIMEOUT
+	c, err = Load("", env(map[string]string{"PAGE_LOAD_TIMEOUT": "15000", "RENDER_TIMEOUT": "1m"}))
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, time.Duration(c.Render.Timeout))
+}
+
+func TestEnvErrors(t *testing.T) {
+	_, err := Load("", env(map[string]string{
+		"PAGE_LOAD_TIMEOUT": "20x",
+		"MAX_TABS":          "ten",
+		"ALLOW_PRIVATE_IPS": "yes please",
+	}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `PAGE_LOAD_TIMEOUT: "20x" is not a duration`)
+	assert.Contains(t, err.Error(), `MAX_TABS: "ten" is not a number`)
+	assert.Contains(t, err.Error(), `ALLOW_PRIVATE_IPS: "yes please" is not true or false`)
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Port = "http"
+	c.Render.Timeout = 0
+	c.Render.DebugPort = 70000
+	c.Cache.Backend = "memcached"
+	c.RateLimits.Client = "ten per second"
+	c.RateLimits.Store = "redis"
+	c.Cache.RedisURL = "localhost:6379"
+
+	err := c.Validate()
+	require.IsType(t, ValidationError{}, err)
+	assert.Len(t, err.(ValidationError), 6)
+	assert.Contains(t, err.Error(), `port: "http" is not a valid port`)
+	assert.Contains(t, err.Error(), "render.timeout: must be positive")
+	assert.Contains(t, err.Error(), "render.debugPort: 70000 is not a valid port")
+	assert.Contains(t, err.Error(), `cache.backend: "memcached" is not redis, s3 or empty`)
+	assert.Contains(t, err.Error(), "rateLimits.client:")
+	assert.Contains(t, err.Error(), "cache.redisURL:")
+
+	c = Default()
+	c.Proxy.Upstream = "origin:8080"
+	c.Proxy.Scheme = "ftp"
+	c.Proxy.Hosts = []string{"[example.com"}
+	err = c.Validate()
+	assert.Contains(t, err.Error(), `proxy.upstream: "origin:8080" is not a http or https URL`)
+	assert.Contains(t, err.Error(), `proxy.scheme: "ftp" is not http, https or empty`)
+	assert.Contains(t, err.Error(), `proxy.hosts: "[example.com" is not a valid pattern`)
+
+	c = Default()
+	c.Changes.Webhook = "hooks.example.com/changes"
+	err = c.Validate()
+	assert.Contains(t, err.Error(), `changes.webhook: "hooks.example.com/changes" is not a http or https URL`)
+	assert.Contains(t, err.Error(), "changes.webhook: pages are compared with their cached version, set cache.backend")
+
+	c = Default()
+	c.Cache.Backend = "s3"
+	assert.EqualError(t, c.Validate(), "invalid config: cache.s3.bucket: must be set with the s3 backend")
+}
+
+func TestRedacted(t *testing.T) {
+	c := Default()
+	c.AdminToken = "admintoken"
+	c.Cache.RedisURL = "redis://:hunter2@redis:6379/0"
+	c.Cache.S3.AccessKey = "AKIA"
+	c.Cache.S3.SecretKey = "shhh"
+
+	data, err := json.Marshal(c.Redacted())
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "admintoken")
+	assert.NotContains(t, string(data), "hunter2")
+	assert.NotContains(t, string(data), "shhh")
+	assert.Contains(t, string(data), `"timeout":"20s"`)
+	// the original is untouched
+	assert.Equal(t, "admintoken", c.AdminToken)
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 
 	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/changes"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/process"
 	"github.com/Mixelito/prerender/render"
 )
 
@@ -16,6 +20,14 @@ func (c contextKey) String() string {
 const (
 	rendererKey = contextKey("renderer")
 	cacheKey    = contextKey("cache")
+	jobsKey     = contextKey("jobs")
+	optionsKey  = contextKey("options")
+	policyKey   = contextKey("policy")
+	tenantKey   = contextKey("tenant")
+	limitsKey   = contextKey("limits")
+	configKey   = contextKey("config")
+	pipelineKey = contextKey("pipeline")
+	changesKey  = contextKey("changes")
 )
 
 func setRenderer(ctx context.Context, r render.Renderer) context.Context {
@@ -36,3 +48,71 @@ func getCache(ctx context.Context) cache.Cache {
 	}
 	return nil
 }
+
+func setJobRunner(ctx context.Context, jr *jobRunner) context.Context {
+	return context.WithValue(ctx, jobsKey, jr)
+}
+func getJobRunner(ctx context.Context) *jobRunner {
+	jr, _ := ctx.Value(jobsKey).(*jobRunner)
+	return jr
+}
+
+func setOptions(ctx context.Context, o *renderOptions) context.Context {
+	return context.WithValue(ctx, optionsKey, o)
+}
+func getOptions(ctx context.Context) *renderOptions {
+	if o, ok := ctx.Value(optionsKey).(*renderOptions); ok {
+		return o
+	}
+	return &renderOptions{Format: formatHTML}
+}
+
+func setPolicy(ctx context.Context, p *guard.Policy) context.Context {
+	return context.WithValue(ctx, policyKey, p)
+}
+func getPolicy(ctx context.Context) *guard.Policy {
+	p, _ := ctx.Value(policyKey).(*guard.Policy)
+	return p
+}
+
+func setTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey, t)
+}
+func getTenant(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantKey).(*tenant)
+	return t
+}
+
+func setRateLimits(ctx context.Context, rl *rateLimits) context.Context {
+	return context.WithValue(ctx, limitsKey, rl)
+}
+func getRateLimits(ctx context.Context) *rateLimits {
+	rl, _ := ctx.Value(limitsKey).(*rateLimits)
+	return rl
+}
+
+func setConfig(ctx context.Context, c *config.Config) context.Context {
+	return context.WithValue(ctx, configKey, c)
+}
+func getConfig(ctx context.Context) *config.Config {
+	if c, ok := ctx.Value(configKey).(*config.Config); ok && c != nil {
+		return c
+	}
+	return config.Default()
+}
+
+func setPipeline(ctx context.Context, p *process.Pipeline) context.Context {
+	return context.WithValue(ctx, pipelineKey, p)
+}
+func getPipeline(ctx context.Context) *process.Pipeline {
+	p, _ := ctx.Value(pipelineKey).(*process.Pipeline)
+	return p
+}
+
+func setChanges(ctx context.Context, d *changes.Detector) context.Context {
+	return context.WithValue(ctx, changesKey, d)
+}
+func getChanges(ctx context.Context) *changes.Detector {
+	d, _ := ctx.Value(changesKey).(*changes.Detector)
+	return d
+}
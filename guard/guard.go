@@ -0,0 +1,221 @@
+package guard
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/pkg/errors"
+)
+
+// ErrForbidden is returned, wrapped with the reason, for URLs the policy
+// does not allow. Use errors.Cause to compare
+var ErrForbidden = errors.New("url not allowed")
+
+// DeniedNetworks are the address ranges that can't be reached unless
+// private addresses are allowed: loopback, private, link-local (including
+// cloud metadata services), carrier-grade NAT, multicast and reserved
+var DeniedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Policy decides which URLs may be rendered
+type Policy struct {
+	// Hosts are the allowed hosts, as exact names or path.Match patterns
+	// like *.example.com. Any host is allowed when empty
+	Hosts []string
+	// Schemes are the allowed URL schemes
+	Schemes []string
+	// AllowPrivate disables the check of resolved addresses against
+	// the denied networks
+	AllowPrivate bool
+
+	// restrict is a second list of hosts that must also match
+	restrict []string
+	denied   []*net.IPNet
+	// lookup resolves host names, replaced in tests
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// NewPolicy creates a policy from the guard configuration, whose denied
+// networks are added to DeniedNetworks
+func NewPolicy(c config.Guard) (*Policy, error) {
+	denied := append(append([]string{}, DeniedNetworks...), c.DeniedNetworks...)
+	return New(c.AllowedHosts, c.AllowedSchemes, c.AllowPrivateIPs, denied)
+}
+
+// New creates a policy allowing hosts and schemes, and denying the
+// networks given in CIDR notation unless allowPrivate is set
+func New(hosts, schemes []string, allowPrivate bool, deniedNetworks []string) (*Policy, error) {
+	p := &Policy{
+		Hosts:        hosts,
+		Schemes:      schemes,
+		AllowPrivate: allowPrivate,
+		lookup:       net.DefaultResolver.LookupIPAddr,
+	}
+	for _, cidr := range deniedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid denied network "+cidr)
+		}
+		p.denied = append(p.denied, network)
+	}
+	for _, host := range hosts {
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, errors.Wrap(err, "invalid allowed host "+host)
+		}
+	}
+	return p, nil
+}
+
+// Check verifies the scheme and host of a URL to render, and that the host
+// does not resolve to a denied address. Whoever fetches the URL resolves
+// the host again, and may get another address: use DialContext to fetch it
+// from Go. Chrome can't be made to, so renders are open to DNS rebinding
+func (p *Policy) Check(ctx context.Context, u *url.URL) error {
+	if err := p.checkScheme(u); err != nil {
+		return err
+	}
+	if !p.hostAllowed(u.Hostname()) {
+		return errors.Wrap(ErrForbidden, "host "+u.Hostname()+" is not allowed")
+	}
+	return p.checkAddress(ctx, u.Hostname())
+}
+
+// CheckSubresource verifies a URL requested by a page being rendered.
+// Pages load from any host, so only the scheme and the resolved
+// addresses are checked
+func (p *Policy) CheckSubresource(ctx context.Context, u *url.URL) error {
+	if err := p.checkScheme(u); err != nil {
+		return err
+	}
+	return p.checkAddress(ctx, u.Hostname())
+}
+
+// Restrict returns a copy of the policy that also requires hosts to match
+// one of hosts. The policy is returned as is when hosts is empty
+func (p *Policy) Restrict(hosts []string) *Policy {
+	if len(hosts) == 0 {
+		return p
+	}
+	restricted := *p
+	restricted.restrict = hosts
+	return &restricted
+}
+
+func (p *Policy) checkScheme(u *url.URL) error {
+	for _, s := range p.Schemes {
+		if strings.EqualFold(s, u.Scheme) {
+			return nil
+		}
+	}
+	return errors.Wrap(ErrForbidden, "scheme "+u.Scheme+" is not allowed")
+}
+
+func (p *Policy) hostAllowed(host string) bool {
+	return MatchHost(p.Hosts, host) && MatchHost(p.restrict, host)
+}
+
+// MatchHost reports whether host matches one of patterns, exact names or
+// path.Match patterns like *.example.com, ignoring case. Any host matches
+// an empty list
+func MatchHost(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) checkAddress(ctx context.Context, host string) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return err
+	}
+	return p.checkIPs(host, ips)
+}
+
+// resolve returns the addresses of host. A host which doesn't resolve is
+// refused: it could resolve to a denied address by the time it is fetched
+func (p *Policy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := p.lookup(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return nil, errors.Wrap(ErrForbidden, "host "+host+" does not resolve")
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func (p *Policy) checkIPs(host string, ips []net.IP) error {
+	for _, ip := range ips {
+		for _, network := range p.denied {
+			if network.Contains(ip) {
+				return errors.Wrap(ErrForbidden, "address "+ip.String()+" of "+host+" is not allowed")
+			}
+		}
+	}
+	return nil
+}
+
+// DialContext connects to addr after checking its addresses, like
+// net.Dialer.DialContext. The connection is made to the addresses checked,
+// so unlike Check followed by a separate lookup, a host can't resolve to
+// an allowed address for the check and to a denied one for the connection.
+// It is meant for the http.Transport of clients calling URLs given by
+// users, where it also covers redirects
+func (p *Policy) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if p.AllowPrivate {
+		return d.DialContext(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.checkIPs(host, ips); err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
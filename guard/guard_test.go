@@ -0,0 +1,120 @@
+package guard
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPolicy(t *testing.T, hosts []string) *Policy {
+	p, err := New(hosts, []string{"http", "https"}, false, DeniedNetworks)
+	require.NoError(t, err)
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "internal.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("10.1.2.3")}}, nil
+		case "nxdomain.example.com":
+			return nil, errors.New("no such host")
+		case "metadata.example.com":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("169.254.169.254")}}, nil
+		}
+		return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+	}
+	return p
+}
+
+func check(p *Policy, raw string) error {
+	u, _ := url.Parse(raw)
+	return p.Check(context.Background(), u)
+}
+
+func TestCheckAddresses(t *testing.T) {
+	p := testPolicy(t, nil)
+	assert.NoError(t, check(p, "https://netlify.com/"))
+	assert.NoError(t, check(p, "http://93.184.216.34/"))
+
+	for _, raw := range []string{
+		"http://169.254.169.254/latest/meta-data/",
+		"http://127.0.0.1:8000/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://192.168.1.1/",
+		"http://internal.example.com/",
+		"http://metadata.example.com/",
+		"http://nxdomain.example.com/",
+	} {
+		err := check(p, raw)
+		assert.Equal(t, ErrForbidden, errors.Cause(err), raw)
+	}
+}
+
+func TestCheckScheme(t *testing.T) {
+	p := testPolicy(t, nil)
+	assert.Equal(t, ErrForbidden, errors.Cause(check(p, "file:///etc/passwd")))
+	assert.Equal(t, ErrForbidden, errors.Cause(check(p, "ftp://netlify.com/")))
+}
+
+func TestCheckHosts(t *testing.T) {
+	p := testPolicy(t, []string{"netlify.com", "*.netlify.com"})
+	assert.NoError(t, check(p, "https://netlify.com/"))
+	assert.NoError(t, check(p, "https://app.Netlify.com/"))
+	assert.Equal(t, ErrForbidden, errors.Cause(check(p, "https://example.com/")))
+	assert.Equal(t, ErrForbidden, errors.Cause(check(p, "https://netlify.com.example.com/")))
+
+	u, _ := url.Parse("https://cdn.example.com/app.js")
+	assert.NoError(t, p.CheckSubresource(context.Background(), u))
+}
+
+func TestRestrict(t *testing.T) {
+	p := testPolicy(t, []string{"*.netlify.com", "*.example.com"})
+	assert.Equal(t, p, p.Restrict(nil))
+
+	restricted := p.Restrict([]string{"app.netlify.com", "netlify.org"})
+	assert.NoError(t, check(restricted, "https://app.netlify.com/"))
+	assert.Equal(t, ErrForbidden, errors.Cause(check(restricted, "https://www.netlify.com/")))
+	// both lists must match
+	assert.Equal(t, ErrForbidden, errors.Cause(check(restricted, "https://netlify.org/")))
+	assert.NoError(t, check(p, "https://www.example.com/"))
+}
+
+func TestAllowPrivate(t *testing.T) {
+	p, err := New(nil, []string{"http"}, true, DeniedNetworks)
+	require.NoError(t, err)
+	assert.NoError(t, check(p, "http://127.0.0.1:8000/"))
+}
+
+func TestDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	p := testPolicy(t, nil)
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	// the addresses dialed are checked, whatever an earlier lookup said
+	_, err = p.DialContext(context.Background(), "tcp", net.JoinHostPort("rebind.example.com", port))
+	assert.Equal(t, ErrForbidden, errors.Cause(err))
+	_, err = p.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.Equal(t, ErrForbidden, errors.Cause(err))
+
+	p, err = New(nil, []string{"http"}, false, []string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	p.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+	conn, err := p.DialContext(context.Background(), "tcp", net.JoinHostPort("app.example.com", port))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestInvalidNetwork(t *testing.T) {
+	_, err := New(nil, []string{"http"}, false, []string{"10.0.0.0"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+)
+
+// readyTimeout bounds each readiness check, a hung Chrome must fail the
+// probe rather than block it
+const readyTimeout = 5 * time.Second
+
+// handleHealthz reports the HTTP server is up, for liveness probes
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// handleReadyz checks Chrome can open a tab and the cache backend is
+// reachable, for readiness probes
+func (a *app) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	if a.isDraining() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+	check := func(name string, ping func() error) {
+		if err := withTimeout(readyTimeout, ping); err != nil {
+			checks[name] = err.Error()
+			ready = false
+		} else {
+			checks[name] = "ok"
+		}
+	}
+
+	if p, ok := a.renderer.(render.Pinger); ok {
+		check("chrome", p.Ping)
+	}
+	if p, ok := a.cache.(cache.Pinger); ok {
+		check("cache", p.Ping)
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+}
+
+// withTimeout runs f, giving up after d
+func withTimeout(d time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		return errors.Errorf("timed out after %s", d)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/changes"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/jobs"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/ratelimit"
+	"github.com/Mixelito/prerender/render"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	jobQueueSize = 1000
+	// jobRateLimitRetries is how many times a job waits for the rate
+	// limit of an origin before giving up on a URL
+	jobRateLimitRetries = 10
+	// jobLease is how long a job is claimed by the instance running it,
+	// the claim is renewed after every URL. The jobs of an instance which
+	// stopped are resumed by the next start once their lease expired
+	jobLease = 10 * time.Minute
+)
+
+// jobRunner renders queued jobs in the background through getData
+type jobRunner struct {
+	config   *config.Config
+	pipeline *process.Pipeline
+	store    jobs.Store
+	renderer render.Renderer
+	cache    cache.Cache
+	policy   *guard.Policy
+	tenants  tenants
+	limits   *rateLimits
+	changes  *changes.Detector
+	queue    chan string
+	webhooks *http.Client
+	// inflight counts the jobs queued or running
+	inflight sync.WaitGroup
+}
+
+func newJobRunner(store jobs.Store, renderer render.Renderer, c cache.Cache, policy *guard.Policy) *jobRunner {
+	webhooks := &http.Client{Timeout: 10 * time.Second}
+	if policy != nil {
+		// webhooks are given by users, they can't reach internal services
+		// either, even through a redirect or a host resolving differently
+		// than when the job was created
+		webhooks.Transport = &http.Transport{DialContext: policy.DialContext}
+	}
+	return &jobRunner{
+		store:    store,
+		renderer: renderer,
+		cache:    c,
+		policy:   policy,
+		queue:    make(chan string, jobQueueSize),
+		webhooks: webhooks,
+	}
+}
+
+// start requeues the jobs interrupted by the last shutdown and launches
+// the workers. The pending jobs still claimed by a running instance are
+// skipped by run
+func (jr *jobRunner) start(workers int) {
+	pending, err := jr.store.Pending()
+	if err != nil {
+		log.WithError(err).Error("error listing pending jobs")
+	}
+	for _, job := range pending {
+		jr.enqueue(job.ID)
+	}
+	for i := 0; i < workers; i++ {
+		go jr.work()
+	}
+}
+
+func (jr *jobRunner) enqueue(id string) {
+	jr.inflight.Add(1)
+	select {
+	case jr.queue <- id:
+	default:
+		// never block the API, the job is persisted and will be picked up
+		go func() { jr.queue <- id }()
+	}
+}
+
+func (jr *jobRunner) work() {
+	for id := range jr.queue {
+		jr.run(id)
+		jr.inflight.Done()
+	}
+}
+
+// drain waits for the queued and running jobs to finish. Jobs still
+// pending when ctx is done are resumed on the next start
+func (jr *jobRunner) drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jr.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (jr *jobRunner) run(id string) {
+	job, err := jr.store.Get(id)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Error("error loading job")
+		return
+	}
+	if job.Finished() {
+		return
+	}
+	if !jr.claim(id) {
+		return
+	}
+
+	var t *tenant
+	if job.Tenant != "" {
+		if t = jr.tenants.byName(job.Tenant); t == nil {
+			// fail the job, or it is requeued on every start
+			log.WithField("job", id).Errorf("unknown tenant %s", job.Tenant)
+			job.Status = jobs.StatusFailed
+			job.Error = "unknown tenant " + job.Tenant
+			jr.finish(job)
+			return
+		}
+	}
+
+	job.Status = jobs.StatusRunning
+	job.Results = nil
+	job.UpdatedAt = time.Now().UTC()
+	if err = jr.store.Save(job); err != nil {
+		log.WithError(err).WithField("job", id).Error("error saving job")
+	}
+
+	failed := 0
+	for i, u := range job.URLs {
+		// the job stops when another instance took it over, not when
+		// the lease can't be renewed
+		if i > 0 {
+			if claimed, err := jr.store.Claim(id, jobLease); err != nil {
+				log.WithError(err).WithField("job", id).Warn("error renewing job lease")
+			} else if !claimed {
+				log.WithField("job", id).Warn("job was taken over by another instance")
+				return
+			}
+		}
+		result := jr.render(u, job.Options, t)
+		if result.Error != "" {
+			failed++
+		}
+		job.Results = append(job.Results, result)
+	}
+
+	job.Status = jobs.StatusDone
+	if failed == len(job.URLs) {
+		job.Status = jobs.StatusFailed
+	}
+	jr.finish(job)
+}
+
+// claim takes or renews the lease of a job, reporting whether this
+// instance may run it
+func (jr *jobRunner) claim(id string) bool {
+	claimed, err := jr.store.Claim(id, jobLease)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Error("error claiming job")
+		return false
+	}
+	if !claimed {
+		log.WithField("job", id).Info("job is run by another instance")
+	}
+	return claimed
+}
+
+// finish calls the webhook of a finished job and saves it
+func (jr *jobRunner) finish(job *jobs.Job) {
+	if job.Webhook != "" {
+		if err := jr.notify(job); err != nil {
+			job.WebhookError = err.Error()
+			log.WithError(err).WithField("job", job.ID).Warn("error calling job webhook")
+		}
+	}
+	job.UpdatedAt = time.Now().UTC()
+	if err := jr.store.Save(job); err != nil {
+		log.WithError(err).WithField("job", job.ID).Error("error saving job")
+	}
+}
+
+func (jr *jobRunner) render(u string, options map[string]string, t *tenant) jobs.Result {
+	ctx := setConfig(context.Background(), jr.config)
+	ctx = setPipeline(ctx, jr.pipeline)
+	ctx = setRenderer(ctx, jr.renderer)
+	ctx = setCache(ctx, jr.cache)
+	ctx = setPolicy(ctx, jr.policy)
+	ctx = setRateLimits(ctx, jr.limits)
+	ctx = setChanges(ctx, jr.changes)
+	if t != nil {
+		ctx = tenantContext(ctx, t)
+	}
+
+	// background jobs wait for the origin instead of failing
+	for retries := 0; ; retries++ {
+		result, err := renderURL(ctx, u, options)
+		limited, ok := err.(*ratelimit.LimitedError)
+		if !ok || retries == jobRateLimitRetries {
+			return result
+		}
+		time.Sleep(limited.RetryAfter)
+	}
+}
+
+// renderURL renders u through getData with the renderer and cache found
+// in ctx, recording any error in the result
+func renderURL(ctx context.Context, u string, options map[string]string) (jobs.Result, error) {
+	result := jobs.Result{URL: u}
+	start := time.Now()
+
+	req, err := newRenderRequest(ctx, u, options)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+
+	res, err := getData(req)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	result.Status = res.Status
+	result.Etag = res.Etag
+	result.HTML = res.HTML
+	return result, nil
+}
+
+// notify posts the finished job to its webhook
+func (jr *jobRunner) notify(job *jobs.Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	resp, err := jr.webhooks.Post(job.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "posting to webhook failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// newRenderRequest builds the request getData expects for u, applying
+// the options of a job or batch
+func newRenderRequest(ctx context.Context, u string, options map[string]string) (*http.Request, error) {
+	opts, err := mapOptions(u, options)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", opts.URL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = opts.URL
+	return req.WithContext(setOptions(ctx, opts)), nil
+}
+
+type jobRequest struct {
+	URLs    []string          `json:"urls"`
+	Options map[string]string `json:"options"`
+	Webhook string            `json:"webhook"`
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	runner := getJobRunner(r.Context())
+	if runner == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	switch {
+	case id == "" && r.Method == "POST":
+		createJob(runner, w, r)
+	case id != "" && r.Method == "GET":
+		getJob(runner, id, w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func createJob(runner *jobRunner, w http.ResponseWriter, r *http.Request) {
+	var jr jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&jr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "invalid job")
+		return
+	}
+	t := getTenant(r.Context())
+	if t != nil {
+		jr.Options = t.withDefaults(jr.Options)
+	}
+	if len(jr.URLs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "urls are required")
+		return
+	}
+	for _, u := range jr.URLs {
+		if _, err := mapOptions(u, jr.Options); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "%s: %s", err, u)
+			return
+		}
+	}
+	if jr.Webhook != "" {
+		parsed, err := url.Parse(jr.Webhook)
+		if err != nil || !parsed.IsAbs() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid webhook URL")
+			return
+		}
+		// the policy of the context has the restrictions of the tenant
+		if policy := getPolicy(r.Context()); policy != nil {
+			if err = policy.Check(r.Context(), parsed); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "webhook: %s", err)
+				return
+			}
+		}
+	}
+
+	job, err := jobs.New(jr.URLs, jr.Options, jr.Webhook)
+	if err == nil {
+		if t != nil {
+			job.Tenant = t.Name
+		}
+		err = runner.store.Save(job)
+	}
+	if err != nil {
+		log.WithError(err).Error("error creating job")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	runner.enqueue(job.ID)
+
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func getJob(runner *jobRunner, id string, w http.ResponseWriter, r *http.Request) {
+	job, err := runner.store.Get(id)
+	if t := getTenant(r.Context()); err == nil && t != nil && job.Tenant != t.Name {
+		// jobs of other tenants don't exist
+		err = jobs.ErrNotFound
+	}
+	if err == jobs.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("error getting job")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("error encoding response")
+	}
+}
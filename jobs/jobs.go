@@ -0,0 +1,416 @@
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Mixelito/prerender/config"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned when no job exists with the requested ID
+var ErrNotFound = errors.New("job not found")
+
+// Status is the lifecycle state of a job
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Job is a set of URLs rendered in the background
+type Job struct {
+	ID           string            `json:"id"`
+	URLs         []string          `json:"urls"`
+	Options      map[string]string `json:"options,omitempty"`
+	Webhook      string            `json:"webhook,omitempty"`
+	Tenant       string            `json:"tenant,omitempty"`
+	Status       Status            `json:"status"`
+	Results      []Result          `json:"results,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	WebhookError string            `json:"webhookError,omitempty"`
+	CreatedAt    time.Time         `json:"createdAt"`
+	UpdatedAt    time.Time         `json:"updatedAt"`
+}
+
+// Result is the outcome of rendering a single URL of a job
+type Result struct {
+	URL      string        `json:"url"`
+	Status   int           `json:"status,omitempty"`
+	Etag     string        `json:"etag,omitempty"`
+	HTML     string        `json:"html,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Finished reports whether the job will not be processed any further
+func (j *Job) Finished() bool {
+	return j.Status == StatusDone || j.Status == StatusFailed
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// New creates a queued job with a random ID
+func New(urls []string, options map[string]string, webhook string) (*Job, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, errors.Wrap(err, "generating job id failed")
+	}
+	now := time.Now().UTC()
+	return &Job{
+		ID:        id,
+		URLs:      urls,
+		Options:   options,
+		Webhook:   webhook,
+		Status:    StatusQueued,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// Store persists jobs so they survive a restart
+type Store interface {
+	Get(id string) (*Job, error)
+	Save(*Job) error
+	// Pending returns the jobs that were queued or running
+	Pending() ([]*Job, error)
+	// Claim takes a job for lease so that the other instances sharing
+	// the store don't run it too. It fails while another store holds an
+	// unexpired claim, and renews the lease of the store's own claim.
+	// Saving the job finished releases it
+	Claim(id string, lease time.Duration) (bool, error)
+}
+
+// newOwner identifies the claims of a store
+func newOwner() string {
+	id, err := newID()
+	if err != nil {
+		id = strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	host, _ := os.Hostname()
+	return host + ":" + id
+}
+
+// NewStore creates a job store using the same backend as the cache:
+// Redis with the redis cache, otherwise JSON files in the jobs directory
+func NewStore(c config.Cache, j config.Jobs) (Store, error) {
+	if c.Backend == "redis" {
+		opts, err := redis.ParseURL(c.RedisURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "error parsing redis url")
+		}
+		return NewRedisStore(redis.NewClient(opts)), nil
+	}
+
+	dir := j.Dir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "prerender-jobs")
+	}
+	store, err := NewFileStore(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating jobs dir")
+	}
+	return store, nil
+}
+
+const (
+	redisJobPrefix   = "prerender:job:"
+	redisPendingKey  = "prerender:jobs:pending"
+	redisLeasePrefix = "prerender:jobs:lease:"
+	// JobTTL is how long finished jobs are kept around for polling
+	JobTTL = 7 * 24 * time.Hour
+)
+
+// RedisStore keeps jobs as JSON strings in Redis
+type RedisStore struct {
+	client *redis.Client
+	owner  string
+}
+
+// NewRedisStore creates a job store backed by Redis
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client, owner: newOwner()}
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) Get(id string) (*Job, error) {
+	data, err := s.client.Get(redisJobPrefix + id).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting job failed")
+	}
+	job := &Job{}
+	if err = json.Unmarshal(data, job); err != nil {
+		return nil, errors.Wrap(err, "decoding job failed")
+	}
+	return job, nil
+}
+
+func (s *RedisStore) Save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "encoding job failed")
+	}
+
+	tx := s.client.TxPipeline()
+	if job.Finished() {
+		tx.Set(redisJobPrefix+job.ID, data, JobTTL)
+		tx.SRem(redisPendingKey, job.ID)
+		tx.Del(redisLeasePrefix + job.ID)
+	} else {
+		tx.Set(redisJobPrefix+job.ID, data, 0)
+		tx.SAdd(redisPendingKey, job.ID)
+	}
+	_, err = tx.Exec()
+	return err
+}
+
+func (s *RedisStore) Pending() ([]*Job, error) {
+	ids, err := s.client.SMembers(redisPendingKey).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing pending jobs failed")
+	}
+	var pending []*Job
+	for _, id := range ids {
+		job, err := s.Get(id)
+		if err == ErrNotFound {
+			s.client.SRem(redisPendingKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, job)
+	}
+	return pending, nil
+}
+
+// Claim sets the lease key of the job, which expires with the lease
+func (s *RedisStore) Claim(id string, lease time.Duration) (bool, error) {
+	key := redisLeasePrefix + id
+	claimed, err := s.client.SetNX(key, s.owner, lease).Result()
+	if err != nil {
+		return false, errors.Wrap(err, "claiming job failed")
+	}
+	if claimed {
+		return true, nil
+	}
+	owner, err := s.client.Get(key).Result()
+	if err == redis.Nil {
+		// the lease expired in between
+		return s.Claim(id, lease)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "claiming job failed")
+	}
+	if owner != s.owner {
+		return false, nil
+	}
+	if err = s.client.PExpire(key, lease).Err(); err != nil {
+		return false, errors.Wrap(err, "renewing job lease failed")
+	}
+	return true, nil
+}
+
+// FileStore keeps each job as a JSON file in a directory. Like in Redis,
+// finished jobs expire after JobTTL
+type FileStore struct {
+	dir   string
+	owner string
+}
+
+// NewFileStore creates a job store in dir, creating it if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, owner: newOwner()}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *FileStore) leasePath(id string) string {
+	return filepath.Join(s.dir, id+".lease")
+}
+
+// validID tells whether id can be a job ID, ids are hex and anything else
+// could escape the directory
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+func (s *FileStore) Get(id string) (*Job, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading job failed")
+	}
+	job := &Job{}
+	if err = json.Unmarshal(data, job); err != nil {
+		return nil, errors.Wrap(err, "decoding job failed")
+	}
+	if job.Finished() && time.Since(job.UpdatedAt) > JobTTL {
+		os.Remove(s.path(id))
+		return nil, ErrNotFound
+	}
+	return job, nil
+}
+
+func (s *FileStore) Save(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "encoding job failed")
+	}
+	// write then rename so a crash never leaves a truncated job behind
+	tmp := s.path(job.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing job failed")
+	}
+	if err = os.Rename(tmp, s.path(job.ID)); err != nil {
+		return err
+	}
+	if job.Finished() {
+		os.Remove(s.leasePath(job.ID))
+		s.expire()
+	}
+	return nil
+}
+
+// fileLease is the content of the lease file of a claimed job
+type fileLease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Claim creates the lease file of the job, only one store can create it.
+// An expired lease is removed before trying again
+func (s *FileStore) Claim(id string, lease time.Duration) (bool, error) {
+	if !validID(id) {
+		return false, ErrNotFound
+	}
+	data, err := json.Marshal(fileLease{Owner: s.owner, Expires: time.Now().Add(lease)})
+	if err != nil {
+		return false, errors.Wrap(err, "encoding job lease failed")
+	}
+	path := s.leasePath(id)
+	if claimed, err := createLease(path, data); claimed || err != nil {
+		return claimed, err
+	}
+
+	current := fileLease{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// released in between
+		return createLease(path, data)
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "reading job lease failed")
+	}
+	if json.Unmarshal(b, &current) != nil {
+		// the lease is being written by another store
+		return false, nil
+	}
+	if current.Owner != s.owner {
+		if time.Now().Before(current.Expires) {
+			return false, nil
+		}
+		os.Remove(path)
+		return createLease(path, data)
+	}
+	// write then rename, like jobs, to renew the lease
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return false, errors.Wrap(err, "writing job lease failed")
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return false, errors.Wrap(err, "writing job lease failed")
+	}
+	return true, nil
+}
+
+// createLease creates the lease file at path, unless it exists
+func createLease(path string, data []byte) (bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "creating job lease failed")
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "writing job lease failed")
+	}
+	return true, nil
+}
+
+// expire removes the jobs finished more than JobTTL ago. Only the files
+// last written before then can be such jobs
+func (s *FileStore) expire() {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && time.Since(info.ModTime()) > JobTTL {
+			// Get removes the file of an expired job
+			s.Get(strings.TrimSuffix(filepath.Base(f), ".json"))
+		}
+	}
+}
+
+func (s *FileStore) Pending() ([]*Job, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var pending []*Job
+	for _, f := range files {
+		job, err := s.Get(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err == ErrNotFound {
+			// expired
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("file", f).Warn("skipping job file")
+			continue
+		}
+		if !job.Finished() {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
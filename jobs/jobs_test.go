@@ -0,0 +1,184 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStore(t *testing.T, store Store) {
+	job, err := New([]string{"https://netlify.com/"}, map[string]string{"refresh": "true"}, "")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(job))
+
+	saved, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusQueued, saved.Status)
+	assert.Equal(t, []string{"https://netlify.com/"}, saved.URLs)
+	assert.Equal(t, "true", saved.Options["refresh"])
+
+	pending, err := store.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, job.ID, pending[0].ID)
+
+	job.Status = StatusDone
+	job.Results = []Result{{URL: "https://netlify.com/", Status: 200}}
+	require.NoError(t, store.Save(job))
+
+	pending, err = store.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	saved, err = store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusDone, saved.Status)
+	assert.Equal(t, 200, saved.Results[0].Status)
+
+	_, err = store.Get("doesnotexist")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+// testClaim checks the claims of two stores sharing a backend, expire
+// makes the current lease expire
+func testClaim(t *testing.T, a, b Store, expire func(id string)) {
+	job, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, a.Save(job))
+
+	claimed, err := a.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = b.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	// a store renews its own claim
+	claimed, err = a.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	expire(job.ID)
+	claimed, err = b.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = a.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	// finishing the job releases the claim
+	job.Status = StatusDone
+	require.NoError(t, b.Save(job))
+	claimed, err = a.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	_, err = store.Get("../jobs")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStoreClaim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	a, err := NewFileStore(dir)
+	require.NoError(t, err)
+	b, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	testClaim(t, a, b, func(id string) {
+		data, err := json.Marshal(fileLease{Owner: a.owner, Expires: time.Now().Add(-time.Second)})
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(a.leasePath(id), data, 0644))
+	})
+
+	// leases aren't jobs
+	pending, err := a.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	_, err = a.Claim("../jobs", time.Minute)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestFileStoreExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileStore(dir)
+	require.NoError(t, err)
+
+	old := time.Now().Add(-JobTTL - time.Hour)
+	finished, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	finished.Status = StatusDone
+	finished.UpdatedAt = old
+	require.NoError(t, store.Save(finished))
+	require.NoError(t, os.Chtimes(store.path(finished.ID), old, old))
+	queued, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	queued.UpdatedAt = old
+	require.NoError(t, store.Save(queued))
+	require.NoError(t, os.Chtimes(store.path(queued.ID), old, old))
+
+	// saving a finished job removes the expired ones
+	done, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	done.Status = StatusDone
+	done.UpdatedAt = time.Now()
+	require.NoError(t, store.Save(done))
+
+	_, err = os.Stat(store.path(finished.ID))
+	assert.True(t, os.IsNotExist(err))
+	_, err = store.Get(finished.ID)
+	assert.Equal(t, ErrNotFound, err)
+	// unfinished jobs never expire
+	_, err = store.Get(queued.ID)
+	assert.NoError(t, err)
+	_, err = store.Get(done.ID)
+	assert.NoError(t, err)
+}
+
+func TestRedisStore(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	testStore(t, NewRedisStore(redis.NewClient(&redis.Options{Addr: s.Addr()})))
+}
+
+func TestRedisStoreClaim(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	a := NewRedisStore(redis.NewClient(&redis.Options{Addr: s.Addr()}))
+	b := NewRedisStore(redis.NewClient(&redis.Options{Addr: s.Addr()}))
+	testClaim(t, a, b, func(string) {
+		s.FastForward(time.Minute)
+	})
+}
+
+func TestNewJobIDs(t *testing.T) {
+	a, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	b, err := New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	assert.Len(t, a.ID, 32)
+	assert.NotEqual(t, a.ID, b.ID)
+}
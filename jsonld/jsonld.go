@@ -0,0 +1,305 @@
+// Package jsonld validates the JSON-LD structured data of pages: the
+// syntax of their scripts and the properties search engines require of
+// common schema.org types
+package jsonld
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Report is the validation of the JSON-LD scripts of a page
+type Report struct {
+	Valid bool `json:"valid"`
+	// Errors counts the errors of all the blocks
+	Errors int     `json:"errors"`
+	Blocks []Block `json:"blocks"`
+}
+
+// Block is the validation of a JSON-LD script
+type Block struct {
+	// Line is the line of the page where the script starts
+	Line   int      `json:"line"`
+	Types  []string `json:"types,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// rules are the properties required by type, a node must have one of the
+// properties of each rule
+var rules = map[string][][]string{
+	"Product":        {{"name"}, {"offers", "review", "aggregateRating"}},
+	"Article":        {{"headline"}, {"author"}, {"datePublished"}},
+	"BreadcrumbList": {{"itemListElement"}},
+	"Organization":   {{"name"}, {"url"}},
+}
+
+// subtypes are validated with the rules of their parent type
+var subtypes = map[string]string{
+	"NewsArticle":             "Article",
+	"BlogPosting":             "Article",
+	"TechArticle":             "Article",
+	"ScholarlyArticle":        "Article",
+	"Report":                  "Article",
+	"Corporation":             "Organization",
+	"NGO":                     "Organization",
+	"EducationalOrganization": "Organization",
+	"GovernmentOrganization":  "Organization",
+	"LocalBusiness":           "Organization",
+	"OnlineStore":             "Organization",
+}
+
+// Validate parses and validates the JSON-LD scripts of a HTML document
+func Validate(doc string) *Report {
+	r := &Report{Blocks: []Block{}}
+	z := html.NewTokenizer(strings.NewReader(doc))
+	line := 1
+	// block is the script being read
+	var block *Block
+	var text []byte
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		// count before Text and TagAttr, which unescape in place
+		newlines := bytes.Count(z.Raw(), []byte("\n"))
+		switch tt {
+		case html.StartTagToken:
+			if name, hasAttr := z.TagName(); string(name) == "script" && hasAttr && isJSONLD(z) {
+				block, text = &Block{Line: line}, nil
+			}
+		case html.TextToken:
+			if block != nil {
+				text = append(text, z.Text()...)
+			}
+		case html.EndTagToken:
+			if block != nil {
+				r.add(block, text)
+				block = nil
+			}
+		}
+		line += newlines
+	}
+	if block != nil {
+		r.add(block, text)
+	}
+	r.Valid = r.Errors == 0
+	return r
+}
+
+// Type is the media type of JSON-LD scripts
+const Type = "application/ld+json"
+
+// MediaType normalizes the type attribute of a script: lower case, without
+// parameters like charset
+func MediaType(typ string) string {
+	if t, _, err := mime.ParseMediaType(typ); err == nil {
+		return t
+	}
+	if i := strings.Index(typ, ";"); i >= 0 {
+		typ = typ[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(typ))
+}
+
+// IsType reports whether the type attribute of a script is that of JSON-LD
+func IsType(typ string) bool {
+	return MediaType(typ) == Type
+}
+
+func isJSONLD(z *html.Tokenizer) bool {
+	for {
+		key, val, more := z.TagAttr()
+		if string(key) == "type" {
+			return IsType(string(val))
+		}
+		if !more {
+			return false
+		}
+	}
+}
+
+func (r *Report) add(b *Block, text []byte) {
+	var v interface{}
+	if len(bytes.TrimSpace(text)) == 0 {
+		b.errorf("empty script")
+	} else if err := json.Unmarshal(text, &v); err != nil {
+		b.errorf("%s", syntaxError(text, err))
+	} else {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			b.validate("", v, true)
+		case []interface{}:
+			for i, item := range v {
+				path := fmt.Sprintf("[%d] ", i)
+				if node, ok := item.(map[string]interface{}); ok {
+					b.validate(path, node, true)
+				} else {
+					b.errorf("%snot an object", path)
+				}
+			}
+		default:
+			b.errorf("not an object")
+		}
+	}
+	r.Errors += len(b.Errors)
+	r.Blocks = append(r.Blocks, *b)
+}
+
+// syntaxError locates a JSON error in the script, lines counted from its
+// first line
+func syntaxError(text []byte, err error) string {
+	serr, ok := err.(*json.SyntaxError)
+	if !ok {
+		return "invalid JSON: " + err.Error()
+	}
+	before := text[:serr.Offset]
+	line := 1 + bytes.Count(before, []byte("\n"))
+	// the error is at the last byte read
+	column := len(before) - 1 - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("syntax error at line %d, column %d: %s", line, column, serr)
+}
+
+// validate checks a node and the nodes of its @graph. Root nodes need a
+// @context
+func (b *Block) validate(path string, node map[string]interface{}, root bool) {
+	if root && !present(node["@context"]) {
+		b.errorf("%smissing @context", path)
+	}
+	if graph, ok := node["@graph"].([]interface{}); ok {
+		for i, item := range graph {
+			itemPath := fmt.Sprintf("%s@graph[%d] ", path, i)
+			if n, ok := item.(map[string]interface{}); ok {
+				b.validate(itemPath, n, false)
+			} else {
+				b.errorf("%snot an object", itemPath)
+			}
+		}
+	}
+	for _, t := range types(node["@type"]) {
+		b.addType(t)
+		base := t
+		if parent, ok := subtypes[t]; ok {
+			base = parent
+		}
+		for _, rule := range rules[base] {
+			if !hasAny(node, rule) {
+				b.errorf("%s%s: missing %s", path, t, quoteAll(rule))
+			}
+		}
+		if base == "BreadcrumbList" {
+			b.breadcrumbs(path+t, node["itemListElement"])
+		}
+	}
+}
+
+// breadcrumbs checks the items of a BreadcrumbList: each needs a position
+// and a name, and all but the last one an item
+func (b *Block) breadcrumbs(path string, elements interface{}) {
+	items, ok := elements.([]interface{})
+	if !ok {
+		return
+	}
+	for i, element := range items {
+		itemPath := fmt.Sprintf("%s: itemListElement[%d]", path, i)
+		item, ok := element.(map[string]interface{})
+		if !ok {
+			b.errorf("%s: not an object", itemPath)
+			continue
+		}
+		if !present(item["position"]) {
+			b.errorf(`%s: missing "position"`, itemPath)
+		}
+		name := item["name"]
+		if target, ok := item["item"].(map[string]interface{}); ok && !present(name) {
+			name = target["name"]
+		}
+		if !present(name) {
+			b.errorf(`%s: missing "name"`, itemPath)
+		}
+		if i < len(items)-1 && !present(item["item"]) {
+			b.errorf(`%s: missing "item"`, itemPath)
+		}
+	}
+}
+
+func (b *Block) errorf(format string, args ...interface{}) {
+	b.Errors = append(b.Errors, fmt.Sprintf(format, args...))
+}
+
+func (b *Block) addType(t string) {
+	for _, known := range b.Types {
+		if known == t {
+			return
+		}
+	}
+	b.Types = append(b.Types, t)
+}
+
+// types returns the schema.org types of a @type value, without their
+// vocabulary prefix
+func types(v interface{}) []string {
+	var values []interface{}
+	switch v := v.(type) {
+	case string:
+		values = []interface{}{v}
+	case []interface{}:
+		values = v
+	}
+	var ts []string
+	for _, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		for _, prefix := range []string{"https://schema.org/", "http://schema.org/", "schema:"} {
+			s = strings.TrimPrefix(s, prefix)
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			ts = append(ts, s)
+		}
+	}
+	return ts
+}
+
+func hasAny(node map[string]interface{}, properties []string) bool {
+	for _, p := range properties {
+		if present(node[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+// present reports whether a property has a value: not null, nor an empty
+// string, list or object
+func present(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case string:
+		return strings.TrimSpace(v) != ""
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// quoteAll lists names as "a", "b" or "c"
+func quoteAll(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = `"` + name + `"`
+	}
+	if len(quoted) == 1 {
+		return quoted[0]
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
@@ -0,0 +1,74 @@
+package jsonld
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateValid(t *testing.T) {
+	r := Validate(`<html><head>
+<script type="application/ld+json">{"@context": "https://schema.org", "@type": "Product",
+  "name": "Shoes", "offers": {"@type": "Offer", "price": "42"}}</script>
+<script src="app.js"></script>
+<script type="application/ld+json">{"@context": "https://schema.org", "@graph": [
+  {"@type": "Organization", "name": "Netlify", "url": "https://www.netlify.com/"},
+  {"@type": "BreadcrumbList", "itemListElement": [
+    {"@type": "ListItem", "position": 1, "item": {"@id": "https://www.netlify.com/", "name": "Home"}},
+    {"@type": "ListItem", "position": 2, "name": "Blog"}]}]}</script>
+</head></html>`)
+	assert.True(t, r.Valid)
+	assert.Equal(t, 0, r.Errors)
+	require.Len(t, r.Blocks, 2)
+	assert.Equal(t, Block{Line: 2, Types: []string{"Product"}}, r.Blocks[0])
+	assert.Equal(t, Block{Line: 5, Types: []string{"Organization", "BreadcrumbList"}}, r.Blocks[1])
+
+	r = Validate(`<html><body><p>No structured data</p></body></html>`)
+	assert.True(t, r.Valid)
+	assert.Empty(t, r.Blocks)
+}
+
+func TestValidateErrors(t *testing.T) {
+	r := Validate(`<html><head>
+<script type="application/ld+json">{"@context": "https://schema.org",
+  "@type": "Product", "name": "Shoes",}</script>
+<script type="application/ld+json">
+  [{"@context": "https://schema.org", "@type": ["NewsArticle"], "headline": "", "author": "Jane"},
+   {"@type": "schema:Organization", "name": "Netlify", "url": "https://www.netlify.com/"}]
+</script>
+<script type="application/ld+json">{"@context": "https://schema.org", "@type": "BreadcrumbList", "itemListElement": [
+  {"position": 1, "name": "Home"}, {"name": "Blog", "item": "https://www.netlify.com/blog/"}]}</script>
+<script type="application/ld+json"> </script>
+</head></html>`)
+	assert.False(t, r.Valid)
+	assert.Equal(t, 7, r.Errors)
+	require.Len(t, r.Blocks, 4)
+	assert.Equal(t, 2, r.Blocks[0].Line)
+	assert.Equal(t, []string{"syntax error at line 2, column 39: invalid character '}' looking for beginning of object key string"}, r.Blocks[0].Errors)
+	assert.Equal(t, []string{"NewsArticle", "Organization"}, r.Blocks[1].Types)
+	assert.Equal(t, []string{
+		`[0] NewsArticle: missing "headline"`,
+		`[0] NewsArticle: missing "datePublished"`,
+		`[1] missing @context`,
+	}, r.Blocks[1].Errors)
+	assert.Equal(t, []string{
+		`BreadcrumbList: itemListElement[0]: missing "item"`,
+		`BreadcrumbList: itemListElement[1]: missing "position"`,
+	}, r.Blocks[2].Errors)
+	assert.Equal(t, 10, r.Blocks[3].Line)
+	assert.Equal(t, []string{"empty script"}, r.Blocks[3].Errors)
+}
+
+func TestMediaType(t *testing.T) {
+	assert.Equal(t, "application/ld+json", MediaType(" Application/LD+JSON; charset=utf-8"))
+	assert.Equal(t, "application/ld+json", MediaType("application/ld+json; charset"))
+	assert.Equal(t, "module", MediaType("module"))
+	assert.Equal(t, "", MediaType(""))
+	assert.True(t, IsType("application/ld+json;charset=UTF-8"))
+	assert.False(t, IsType("application/json"))
+
+	r := Validate(`<script type="application/ld+json; charset=utf-8">{"@context": "https://schema.org", "@type": "Thing"}</script>`)
+	require.Len(t, r.Blocks, 1)
+	assert.Equal(t, []string{"Thing"}, r.Blocks[0].Types)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/ratelimit"
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-redis/redis"
+)
+
+// rateLimits throttles the clients of the API, and the renders per origin
+// host so a single site isn't hammered by Chrome
+type rateLimits struct {
+	limiter ratelimit.Limiter
+	client  ratelimit.Limit
+	origin  ratelimit.Limit
+}
+
+// tenantLimits override the rate limits for a tenant
+type tenantLimits struct {
+	Client *ratelimit.Limit `json:"client"`
+	Origin *ratelimit.Limit `json:"origin"`
+}
+
+// newRateLimits reads the client and origin limits. Buckets are kept in
+// the Redis at redisURL with the redis store so limits hold across
+// replicas
+func newRateLimits(c config.RateLimits, redisURL string) (*rateLimits, error) {
+	client, err := ratelimit.ParseLimit(c.Client)
+	if err != nil {
+		return nil, err
+	}
+	origin, err := ratelimit.ParseLimit(c.Origin)
+	if err != nil {
+		return nil, err
+	}
+
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter()
+	if c.Store == "redis" {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		limiter = ratelimit.NewRedisLimiter(redis.NewClient(opts))
+	}
+	return &rateLimits{limiter: limiter, client: client, origin: origin}, nil
+}
+
+// allowClient limits the requests of a tenant, or of a client IP when
+// authentication is disabled
+func (rl *rateLimits) allowClient(r *http.Request) error {
+	limit := rl.client
+	var key string
+	if t := getTenant(r.Context()); t != nil {
+		key = "tenant:" + t.Name
+		if t.RateLimits.Client != nil {
+			limit = *t.RateLimits.Client
+		}
+	} else {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		key = "ip:" + ip
+	}
+	return rl.allow(key, limit)
+}
+
+// allowOrigin limits the renders of pages of host. Each tenant has its own
+// buckets, with its own limit, so one tenant can't use up the renders of
+// the others
+func (rl *rateLimits) allowOrigin(ctx context.Context, host string) error {
+	limit := rl.origin
+	key := "origin:" + host
+	if t := getTenant(ctx); t != nil {
+		key = "origin:" + t.Name + ":" + host
+		if t.RateLimits.Origin != nil {
+			limit = *t.RateLimits.Origin
+		}
+	}
+	return rl.allow(key, limit)
+}
+
+func (rl *rateLimits) allow(key string, limit ratelimit.Limit) error {
+	err := rl.limiter.Allow(key, limit)
+	if _, limited := err.(*ratelimit.LimitedError); err != nil && !limited {
+		// don't turn a limiter outage into an API outage
+		log.WithError(err).Error("error checking rate limit")
+		return nil
+	}
+	return err
+}
+
+// setRetryAfter sets the Retry-After header, in seconds
+func setRetryAfter(h http.Header, err *ratelimit.LimitedError) {
+	h.Set("Retry-After", fmt.Sprint(int(math.Ceil(err.RetryAfter.Seconds()))))
+}
+
+// writeLimited responds 429 with the Retry-After header
+func writeLimited(w http.ResponseWriter, err *ratelimit.LimitedError) {
+	setRetryAfter(w.Header(), err)
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, err.Error())
+}
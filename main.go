@@ -1,49 +1,198 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
-	_"os/signal"
-	_"syscall"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	_"context"
-
 	log "github.com/Sirupsen/logrus"
 	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/changes"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/jobs"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/ratelimit"
 	"github.com/Mixelito/prerender/render"
 	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// app holds the long-lived dependencies of the request handlers
+type app struct {
+	config   *config.Config
+	pipeline *process.Pipeline
+	renderer render.Renderer
+	cache    cache.Cache
+	runner   *jobRunner
+	policy   *guard.Policy
+	tenants  tenants
+	limits   *rateLimits
+	// changes is set when content changes are posted to a webhook
+	changes *changes.Detector
+	// proxy is set in reverse proxy mode
+	proxy *proxy
+	// draining is set to 1 once shutdown started
+	draining int32
+}
+
+// serve sets up the request context and routes the request to its
+// endpoint, returning the render result if there was one.
+// A custom handler is necessary because ServeMux redirects // to /
+// in all urls, regardless of escaping
+func (a *app) serve(w http.ResponseWriter, r *http.Request) *render.Result {
+	// probes and scrapers don't authenticate
+	switch r.URL.Path {
+	case "/metrics":
+		promhttp.Handler().ServeHTTP(w, r)
+		return nil
+	case "/healthz":
+		handleHealthz(w, r)
+		return nil
+	case "/readyz":
+		a.handleReadyz(w, r)
+		return nil
+	case "/admin/config":
+		a.handleAdminConfig(w, r)
+		return nil
+	}
+
+	ctx := a.context(r.Context())
+	if a.tenants != nil {
+		t := a.tenants.authenticate(r)
+		if t == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "invalid or missing token")
+			return nil
+		}
+		ctx = tenantContext(ctx, t)
+	}
+	r = r.WithContext(ctx)
+
+	if a.limits != nil {
+		if err := a.limits.allowClient(r); err != nil {
+			writeLimited(w, err.(*ratelimit.LimitedError))
+			return nil
+		}
+	}
+
+	switch {
+	case r.URL.Path == "/jobs" || strings.HasPrefix(r.URL.Path, "/jobs/"):
+		handleJobs(w, r)
+		return nil
+	case r.URL.Path == "/render/batch":
+		handleBatch(w, r)
+		return nil
+	default:
+		return handle(w, r)
+	}
+}
+
+// context returns ctx carrying the dependencies of the handlers
+func (a *app) context(ctx context.Context) context.Context {
+	ctx = setConfig(ctx, a.config)
+	ctx = setPipeline(ctx, a.pipeline)
+	ctx = setRenderer(ctx, a.renderer)
+	ctx = setCache(ctx, a.cache)
+	ctx = setJobRunner(ctx, a.runner)
+	ctx = setPolicy(ctx, a.policy)
+	ctx = setChanges(ctx, a.changes)
+	return setRateLimits(ctx, a.limits)
+}
+
 func main() {
-	var renderer render.Renderer
-	var res *render.Result
-	var err error
-	renderer, err = render.NewRenderer()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
+	conf, err := config.Load(os.Getenv("CONFIG_FILE"), os.Getenv)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer renderer.Close()
-	if os.Getenv("RENDER_TIMEOUT") != "" {
-		if t, perr := time.ParseDuration(os.Getenv("RENDER_TIMEOUT")); perr == nil {
-			renderer.SetPageLoadTimeout(t)
-		}
+
+	policy, err := guard.NewPolicy(conf.Guard)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// a custom handler is necessary because ServeMux redirects // to /
-	// in all urls, regardless of escaping
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := setRenderer(r.Context(), renderer)
-		ctx = setCache(ctx, cache.NewCache())
-		res = handle(w, r.WithContext(ctx))
-	})
+	pipeline, err := process.NewPipeline(conf.ProcessorSteps())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tenants, err := loadTenants(conf.TenantsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limits, err := newRateLimits(conf.RateLimits, conf.Cache.RedisURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := cache.NewCache(conf.Cache)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := jobs.NewStore(conf.Cache, conf.Jobs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	detector, err := changes.New(conf.Changes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	renderer, err := render.NewRenderer(conf.Render, policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runner := newJobRunner(store, renderer, c, policy)
+	runner.config = conf
+	runner.pipeline = pipeline
+	runner.tenants = tenants
+	runner.limits = limits
+	runner.changes = detector
+	runner.start(conf.Jobs.Workers)
+	registerJobQueue(runner)
+
+	a := &app{
+		config:   conf,
+		pipeline: pipeline,
+		renderer: renderer,
+		cache:    c,
+		runner:   runner,
+		policy:   policy,
+		tenants:  tenants,
+		limits:   limits,
+		changes:  detector,
+	}
+	serve := a.serve
+	if conf.Proxy.Upstream != "" {
+		if a.proxy, err = newProxy(conf.Proxy); err != nil {
+			log.Fatal(err)
+		}
+		serve = a.serveProxy
+		log.Printf("proxying to %s", conf.Proxy.Upstream)
+	}
 	wrappedHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		m := httpsnoop.CaptureMetrics(handler, w, r)
+		var res *render.Result
+		m := httpsnoop.CaptureMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res = serve(w, r)
+		}), w, r)
 		log.WithFields(log.Fields{
 			"method":   r.Method,
 			"path":     r.URL.Path,
-			"cached":	res.Cached,
+			"cached":	res != nil && res.Cached,
 			"status":   m.Code,
 			"duration": m.Duration.Nanoseconds(),
 			"durationH": m.Duration.String(),
@@ -52,29 +201,23 @@ func main() {
 		}).Infof("Completed request")
 	})
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
-	}
-	l := fmt.Sprintf(":%s", port)
+	l := fmt.Sprintf(":%s", conf.Port)
 	log.Printf("listening on %s", l)
 	server := http.Server{Addr: l, Handler: wrappedHandler}
 
-	/*
+	errc := make(chan error, 1)
 	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		log.Info("signal caught, shutting down")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
-
+		errc <- server.ListenAndServe()
 	}()
-	*/
 
-	err = server.ListenAndServe()
-	if err != http.ErrServerClosed {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-errc:
 		log.Error(err)
+		renderer.Close()
+	case s := <-sig:
+		log.Infof("%s caught, shutting down", s)
+		a.shutdown(&server, time.Duration(conf.Shutdown.Delay), time.Duration(conf.Shutdown.Timeout))
 	}
 }
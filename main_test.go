@@ -1,18 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/alicebob/miniredis"
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/changes"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/jobs"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/ratelimit"
 	"github.com/Mixelito/prerender/render"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMain(m *testing.M) {
@@ -51,7 +67,8 @@ type MockRenderer struct {
 	mock.Mock
 }
 
-func (r *MockRenderer) Render(url string) (*render.Result, error) {
+func (r *MockRenderer) Render(req *http.Request) (*render.Result, error) {
+	url := req.URL.String()
 	args := r.Called(url)
 	err := args.Error(0)
 	if err != nil {
@@ -240,3 +257,1164 @@ func TestCacheSaveError(t *testing.T) {
 	r.AssertExpectations(t)
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 }
+
+func TestJobLifecycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+
+	hooked := make(chan jobs.Job, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job jobs.Job
+		json.NewDecoder(r.Body).Decode(&job)
+		hooked <- job
+	}))
+	defer webhook.Close()
+
+	r := new(MockRenderer)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	runner := newJobRunner(store, r, nil, nil)
+
+	body := `{"urls": ["https://netlify.com/"], "webhook": "` + webhook.URL + `"}`
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handleJobs(w, req.WithContext(setJobRunner(req.Context(), runner)))
+
+	resp := w.Result()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var created jobs.Job
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, jobs.StatusQueued, created.Status)
+	assert.Equal(t, "/jobs/"+created.ID, resp.Header.Get("Location"))
+
+	runner.run(<-runner.queue)
+	r.AssertExpectations(t)
+
+	job := <-hooked
+	assert.Equal(t, created.ID, job.ID)
+	assert.Equal(t, jobs.StatusDone, job.Status)
+
+	req = httptest.NewRequest("GET", "/jobs/"+created.ID, nil)
+	w = httptest.NewRecorder()
+	handleJobs(w, req.WithContext(setJobRunner(req.Context(), runner)))
+
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+	assert.Equal(t, jobs.StatusDone, job.Status)
+	require.Len(t, job.Results, 1)
+	assert.Equal(t, http.StatusOK, job.Results[0].Status)
+	assert.Equal(t, "<html></html>", job.Results[0].HTML)
+}
+
+func TestJobValidation(t *testing.T) {
+	runner := newJobRunner(nil, nil, nil, nil)
+	for _, body := range []string{`{}`, `{"urls": ["netlify.com"]}`, `not json`} {
+		req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handleJobs(w, req.WithContext(setJobRunner(req.Context(), runner)))
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, body)
+	}
+}
+
+func TestJobWebhookForbidden(t *testing.T) {
+	policy, err := guard.New(nil, []string{"http", "https"}, false, guard.DeniedNetworks)
+	require.NoError(t, err)
+	runner := newJobRunner(nil, nil, nil, policy)
+	for _, test := range []struct {
+		webhook string
+		policy  *guard.Policy
+	}{
+		{"http://169.254.169.254/latest/meta-data/", policy},
+		{"http://127.0.0.1:8000/admin", policy},
+		{"file:///etc/passwd", policy},
+		// the hosts of the tenant
+		{"https://93.184.216.34/hook", policy.Restrict([]string{"*.acme.com"})},
+	} {
+		req := httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"urls": ["https://www.acme.com/"], "webhook": "`+test.webhook+`"}`))
+		ctx := setJobRunner(req.Context(), runner)
+		ctx = setPolicy(ctx, test.policy)
+		w := httptest.NewRecorder()
+		handleJobs(w, req.WithContext(ctx))
+		assert.Equal(t, http.StatusForbidden, w.Result().StatusCode, test.webhook)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	r := new(MockRenderer)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	r.On("Render", "https://netlify.com/blog/").Return(errors.New("random error")).Once()
+
+	body := `{"urls": ["https://netlify.com/", "https://netlify.com/blog/"]}`
+	req := httptest.NewRequest("POST", "/render/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handleBatch(w, req.WithContext(setRenderer(req.Context(), r)))
+
+	resp := w.Result()
+	r.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	results := map[string]jobs.Result{}
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var result jobs.Result
+		require.NoError(t, dec.Decode(&result))
+		results[result.URL] = result
+	}
+	require.Len(t, results, 2)
+	assert.Equal(t, "<html></html>", results["https://netlify.com/"].HTML)
+	assert.Equal(t, "random error", results["https://netlify.com/blog/"].Error)
+}
+
+func TestBatchTooManyURLs(t *testing.T) {
+	urls := make([]string, config.Default().Batch.MaxURLs+1)
+	for i := range urls {
+		urls[i] = "https://netlify.com/"
+	}
+	body, _ := json.Marshal(batchRequest{URLs: urls})
+	req := httptest.NewRequest("POST", "/render/batch", strings.NewReader(string(body)))
+	w := httptest.NewRecorder()
+	handleBatch(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestJSONFormat(t *testing.T) {
+	r := new(MockRenderer)
+	req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	req.Header.Set("X-Prerender-Format", "json")
+	pipeline, err := process.NewPipeline(config.Default().ProcessorSteps())
+	require.NoError(t, err)
+	ctx := setRenderer(req.Context(), r)
+	ctx = setPipeline(ctx, pipeline)
+	w := httptest.NewRecorder()
+
+	html := `<html><head><title>Netlify</title><meta name="prerender-status-code" content="404"></head></html>`
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	handle(w, req.WithContext(ctx))
+
+	resp := w.Result()
+	r.AssertExpectations(t)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var res render.Result
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, http.StatusNotFound, res.Status)
+	assert.Equal(t, "etagetag", res.Etag)
+	assert.Equal(t, "Netlify", res.Meta.Title)
+	assert.NotContains(t, res.HTML, "prerender-status-code")
+}
+
+func TestJSONFormatError(t *testing.T) {
+	r := new(MockRenderer)
+	req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	ctx := setRenderer(req.Context(), r)
+	w := httptest.NewRecorder()
+
+	r.On("Render", "https://netlify.com/").Return(render.ErrPageLoadTimeout).Once()
+	handle(w, req.WithContext(ctx))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.JSONEq(t, `{"error": "timed out waiting for page load"}`, string(body))
+}
+
+func TestQueryAPI(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	req := httptest.NewRequest("GET", "/render?url=https%3A%2F%2Fnetlify.com%2F%3Fa%3D1&format=json&refresh=true", nil)
+	ctx := setRenderer(req.Context(), r)
+	ctx = setCache(ctx, c)
+	w := httptest.NewRecorder()
+
+	c.On("Save", mock.Anything, 24*time.Hour).Return(nil)
+	r.On("Render", "https://netlify.com/?a=1").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	handle(w, req.WithContext(ctx))
+
+	resp := w.Result()
+	r.AssertExpectations(t)
+	// refresh skips the cache check but still saves
+	c.AssertNotCalled(t, "Check", mock.Anything)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+}
+
+func TestQueryAPIErrors(t *testing.T) {
+	for _, target := range []string{
+		"/render",
+		"/render?url=netlify.com",
+		"/render?url=https://netlify.com/&format=xml",
+		"/render?url=https://netlify.com/&wait=soon",
+	} {
+		req := httptest.NewRequest("GET", target, nil)
+		w := httptest.NewRecorder()
+		handle(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode, target)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := mapOptions("https://example.com/?_escaped_fragment_=key1=value1%26key2=value2", map[string]string{
+		"wait":      "500",
+		"timeout":   "5s",
+		"userAgent": "Googlebot",
+		"refresh":   "1",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/%23%21key1=value1&key2=value2", opts.URL.String())
+	assert.Equal(t, formatHTML, opts.Format)
+	assert.Equal(t, 500*time.Millisecond, opts.Render.Wait)
+	assert.Equal(t, 5*time.Second, opts.Render.Timeout)
+	assert.Equal(t, "Googlebot", opts.Render.UserAgent)
+	assert.True(t, opts.Refresh)
+}
+
+func TestLegacyOptions(t *testing.T) {
+	req := httptest.NewRequest("POST", "/https://netlify.com/?a=1", nil)
+	req.Header.Set("X-Prerender-Wait", "1s")
+	req.Header.Set("Accept", "application/json")
+	opts, err := legacyOptions(req)
+	require.NoError(t, err)
+	assert.Equal(t, "https://netlify.com/?a=1", opts.URL.String())
+	assert.Equal(t, formatJSON, opts.Format)
+	assert.Equal(t, time.Second, opts.Render.Wait)
+	assert.True(t, opts.Refresh)
+}
+
+func TestLegacyOptionsTwoQueries(t *testing.T) {
+	// the query of a decoded escaped fragment follows the one of the URL
+	req := httptest.NewRequest("GET", "/https://netlify.com/?a=1?b=2", nil)
+	opts, err := legacyOptions(req)
+	require.NoError(t, err)
+	assert.Equal(t, "https://netlify.com/?a=1&b=2", opts.URL.String())
+	assert.Equal(t, "2", opts.URL.Query().Get("b"))
+}
+
+func TestForbiddenURL(t *testing.T) {
+	policy, err := guard.New([]string{"*.netlify.com"}, []string{"https"}, false, guard.DeniedNetworks)
+	require.NoError(t, err)
+
+	for _, target := range []string{
+		"/http://169.254.169.254/latest/meta-data/",
+		"/https://127.0.0.1/",
+		"/https://example.com/",
+		"/http://app.netlify.com/",
+	} {
+		r := new(MockRenderer)
+		req := httptest.NewRequest("GET", target, nil)
+		ctx := setRenderer(req.Context(), r)
+		ctx = setPolicy(ctx, policy)
+		w := httptest.NewRecorder()
+		handle(w, req.WithContext(ctx))
+
+		assert.Equal(t, http.StatusForbidden, w.Result().StatusCode, target)
+		r.AssertNotCalled(t, "Render", mock.Anything)
+	}
+}
+
+func testTenants(t *testing.T) tenants {
+	f, err := ioutil.TempFile("", "tenants")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(`{"tenants": [
+		{"name": "acme", "tokens": ["acmetoken"], "allowedHosts": ["*.acme.com"], "options": {"format": "json"}},
+		{"name": "netlify", "tokens": ["netlifytoken", "oldtoken"]}
+	]}`)
+	f.Close()
+
+	ts, err := loadTenants(f.Name())
+	require.NoError(t, err)
+	return ts
+}
+
+func TestLoadTenants(t *testing.T) {
+	ts := testTenants(t)
+	require.Len(t, ts, 2)
+	assert.Equal(t, "acme", ts[0].CacheNamespace)
+
+	ts, err := loadTenants("")
+	require.NoError(t, err)
+	assert.Nil(t, ts)
+}
+
+func TestAuthentication(t *testing.T) {
+	policy, err := guard.New(nil, []string{"https"}, true, nil)
+	require.NoError(t, err)
+	r := new(MockRenderer)
+	a := &app{renderer: r, policy: policy, tenants: testTenants(t)}
+
+	req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	w := httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	req.Header.Set("X-Prerender-Token", "wrongtoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	req = httptest.NewRequest("GET", "/render?url=https://netlify.com/&token=oldtoken", nil)
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	r.AssertExpectations(t)
+
+	// acme may only render its own hosts
+	req = httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	req.Header.Set("X-Prerender-Token", "acmetoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// and gets JSON by default
+	r.On("Render", "https://www.acme.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	req = httptest.NewRequest("GET", "/https://www.acme.com/", nil)
+	req.Header.Set("X-Prerender-Token", "acmetoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+	r.AssertExpectations(t)
+}
+
+func TestTenantJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+
+	ts := testTenants(t)
+	runner := newJobRunner(store, nil, nil, nil)
+	runner.tenants = ts
+	a := &app{runner: runner, tenants: ts}
+
+	req := httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"urls": ["https://www.acme.com/"]}`))
+	req.Header.Set("X-Prerender-Token", "acmetoken")
+	w := httptest.NewRecorder()
+	a.serve(w, req)
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+	var job jobs.Job
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&job))
+	assert.Equal(t, "acme", job.Tenant)
+	assert.Equal(t, "json", job.Options["format"])
+
+	req = httptest.NewRequest("GET", "/jobs/"+job.ID, nil)
+	req.Header.Set("X-Prerender-Token", "netlifytoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/jobs/"+job.ID, nil)
+	req.Header.Set("X-Prerender-Token", "acmetoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestJobUnknownTenant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+	runner := newJobRunner(store, nil, nil, nil)
+	runner.tenants = testTenants(t)
+
+	job, err := jobs.New([]string{"https://www.acme.com/"}, nil, "")
+	require.NoError(t, err)
+	job.Tenant = "removed"
+	require.NoError(t, store.Save(job))
+	runner.run(job.ID)
+
+	saved, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusFailed, saved.Status)
+	assert.Equal(t, "unknown tenant removed", saved.Error)
+	pending, err := store.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestJobClaimed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+	// another instance sharing the jobs
+	other, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+
+	r := new(MockRenderer)
+	runner := newJobRunner(store, r, nil, nil)
+	job, err := jobs.New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(job))
+	claimed, err := other.Claim(job.ID, time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	runner.run(job.ID)
+	r.AssertNotCalled(t, "Render", "https://netlify.com/")
+	saved, err := store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusQueued, saved.Status)
+}
+
+func TestClientRateLimit(t *testing.T) {
+	r := new(MockRenderer)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1)
+	limits := &rateLimits{
+		limiter: ratelimit.NewMemoryLimiter(),
+		client:  ratelimit.Limit{Rate: 0.1, Burst: 1},
+	}
+	a := &app{renderer: r, limits: limits}
+
+	req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	w := httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Result().StatusCode)
+	assert.Equal(t, "10", w.Result().Header.Get("Retry-After"))
+
+	// other clients have their own bucket
+	req = httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestOriginRateLimit(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	c.On("Check", mock.Anything).Return(nil, 0)
+	c.On("Save", mock.Anything, 24*time.Hour).Return(nil)
+	limits := &rateLimits{
+		limiter: ratelimit.NewMemoryLimiter(),
+		origin:  ratelimit.Limit{Rate: 0.5, Burst: 1},
+	}
+
+	for i, status := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+		ctx := setRenderer(req.Context(), r)
+		ctx = setCache(ctx, c)
+		ctx = setRateLimits(ctx, limits)
+		w := httptest.NewRecorder()
+		handle(w, req.WithContext(ctx))
+		assert.Equal(t, status, w.Result().StatusCode)
+	}
+	r.AssertExpectations(t)
+}
+
+func TestTenantOriginRateLimit(t *testing.T) {
+	limits := &rateLimits{
+		limiter: ratelimit.NewMemoryLimiter(),
+		origin:  ratelimit.Limit{Rate: 0.5, Burst: 1},
+	}
+	low := &tenant{Name: "low", RateLimits: tenantLimits{Origin: &ratelimit.Limit{Rate: 0.5, Burst: 1}}}
+	high := &tenant{Name: "high", RateLimits: tenantLimits{Origin: &ratelimit.Limit{Rate: 1, Burst: 3}}}
+	lowCtx := setTenant(context.Background(), low)
+	highCtx := setTenant(context.Background(), high)
+
+	assert.NoError(t, limits.allowOrigin(lowCtx, "netlify.com"))
+	assert.IsType(t, &ratelimit.LimitedError{}, limits.allowOrigin(lowCtx, "netlify.com"))
+	// the low limit of a tenant doesn't apply to the others
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, limits.allowOrigin(highCtx, "netlify.com"), i)
+	}
+	assert.IsType(t, &ratelimit.LimitedError{}, limits.allowOrigin(highCtx, "netlify.com"))
+	assert.NoError(t, limits.allowOrigin(context.Background(), "netlify.com"))
+}
+
+func TestMetrics(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	c.On("Check", mock.Anything).Return(nil, 0).Once()
+	c.On("Check", mock.Anything).Return(nil, http.StatusOK, "<html></html>", "etagetag", 0).Once()
+	c.On("Save", mock.Anything, 24*time.Hour).Return(nil)
+	// metrics are never rate limited nor authenticated
+	a := &app{renderer: r, cache: c, tenants: testTenants(t), limits: &rateLimits{
+		limiter: ratelimit.NewMemoryLimiter(),
+		client:  ratelimit.Limit{Rate: 0.1, Burst: 1},
+	}}
+
+	misses := testutil.ToFloat64(cacheRequests.WithLabelValues("other", "miss"))
+	hits := testutil.ToFloat64(cacheRequests.WithLabelValues("other", "hit"))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", i)
+		ctx := setRenderer(req.Context(), r)
+		ctx = setCache(ctx, c)
+		handle(httptest.NewRecorder(), req.WithContext(ctx))
+	}
+	assert.Equal(t, misses+1, testutil.ToFloat64(cacheRequests.WithLabelValues("other", "miss")))
+	assert.Equal(t, hits+1, testutil.ToFloat64(cacheRequests.WithLabelValues("other", "hit")))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		a.serve(w, httptest.NewRequest("GET", "/metrics", nil))
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+		assert.Contains(t, string(body), `prerender_cache_requests_total{backend="other",result="hit"}`)
+		assert.Contains(t, string(body), `prerender_render_duration_seconds_bucket{status="200"`)
+	}
+}
+
+// pingRenderer is a MockRenderer whose Ping returns err
+type pingRenderer struct {
+	MockRenderer
+	err error
+}
+
+func (r *pingRenderer) Ping() error {
+	return r.err
+}
+
+func TestHealthz(t *testing.T) {
+	a := &app{renderer: &pingRenderer{err: errors.New("chrome is gone")}, tenants: testTenants(t)}
+	w := httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/healthz", nil))
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestReadyz(t *testing.T) {
+	r := &pingRenderer{}
+	a := &app{renderer: r, tenants: testTenants(t)}
+
+	w := httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/readyz", nil))
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.JSONEq(t, `{"ready": true, "checks": {"chrome": "ok"}}`, string(body))
+
+	r.err = errors.New("chrome is gone")
+	w = httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/readyz", nil))
+	body, _ = ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	assert.JSONEq(t, `{"ready": false, "checks": {"chrome": "chrome is gone"}}`, string(body))
+}
+
+func TestReadyzTimeout(t *testing.T) {
+	err := withTimeout(10*time.Millisecond, func() error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	assert.EqualError(t, err, "timed out after 10ms")
+}
+
+func TestShutdown(t *testing.T) {
+	r := &pingRenderer{}
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+	dir, err := ioutil.TempDir("", "prerender-jobs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := jobs.NewFileStore(dir)
+	require.NoError(t, err)
+	runner := newJobRunner(store, r, nil, nil)
+	a := &app{renderer: r, runner: runner}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		a.serve(w, req)
+	}))
+	defer server.Close()
+
+	job, err := jobs.New([]string{"https://netlify.com/"}, nil, "")
+	require.NoError(t, err)
+	require.NoError(t, store.Save(job))
+	runner.enqueue(job.ID)
+	runner.start(1)
+
+	a.shutdown(server.Config, 0, 5*time.Second)
+	r.AssertExpectations(t)
+	job, err = store.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StatusDone, job.Status)
+
+	w := httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+}
+
+func TestAdminConfig(t *testing.T) {
+	conf := config.Default()
+	a := &app{config: conf, tenants: testTenants(t)}
+	w := httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/admin/config", nil))
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	conf.AdminToken = "admintoken"
+	conf.Cache.S3.SecretKey = "shhh"
+	w = httptest.NewRecorder()
+	a.serve(w, httptest.NewRequest("GET", "/admin/config", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req := httptest.NewRequest("GET", "/admin/config", nil)
+	req.Header.Set("X-Prerender-Token", "admintoken")
+	w = httptest.NewRecorder()
+	a.serve(w, req)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	assert.Contains(t, string(body), `"maxTabs":10`)
+	assert.NotContains(t, string(body), "shhh")
+	assert.NotContains(t, string(body), "admintoken")
+}
+
+func TestSoftErrorNotCached(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	html := `<html><head><title>Page not found</title></head><body><div id="app"></div></body></html>`
+	r.On("Render", "https://netlify.com/missing").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	c.On("Check", mock.Anything).Return(nil, 0).Once()
+
+	pipeline, err := process.NewPipeline([]config.Processor{{Name: "softErrors", Options: map[string]string{"notFoundTitle": "not found"}}})
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/https://netlify.com/missing", nil)
+	req.Header.Set("X-Prerender-Format", "json")
+	ctx := setRenderer(req.Context(), r)
+	ctx = setCache(ctx, c)
+	ctx = setPipeline(ctx, pipeline)
+	w := httptest.NewRecorder()
+	handle(w, req.WithContext(ctx))
+
+	resp := w.Result()
+	r.AssertExpectations(t)
+	c.AssertExpectations(t)
+	c.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var res render.Result
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, `not found: title "Page not found" matches not found`, res.Failure)
+}
+
+func TestProcessors(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	html := `<html><head><meta name="prerender-header" content="Location: https://www.netlify.com/"><meta name="prerender-status-code" content="301"></head><body><script>app()</script></body></html>`
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	c.On("Check", mock.Anything).Return(nil, 0).Once()
+	// the processed page is cached
+	c.On("Save", mock.MatchedBy(func(res *render.Result) bool {
+		return res.Status == http.StatusMovedPermanently && res.HTML == "<html><head></head><body></body></html>"
+	}), 24*time.Hour).Return(nil).Once()
+
+	pipeline, err := process.NewPipeline(config.Default().ProcessorSteps())
+	require.NoError(t, err)
+	req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+	ctx := setRenderer(req.Context(), r)
+	ctx = setCache(ctx, c)
+	ctx = setPipeline(ctx, pipeline)
+	w := httptest.NewRecorder()
+	handle(w, req.WithContext(ctx))
+
+	resp := w.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	r.AssertExpectations(t)
+	c.AssertExpectations(t)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "https://www.netlify.com/", resp.Header.Get("Location"))
+	assert.Equal(t, "<html><head></head><body></body></html>", string(body))
+}
+
+func TestTenantProcessors(t *testing.T) {
+	f, err := ioutil.TempFile("", "tenants")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"tenants": [{"name": "acme", "tokens": ["acmetoken"], "processors": [{"name": "stripScripts", "hosts": ["*.netlify.com"], "options": {"keep": "text/template"}}]}]}`)
+	f.Close()
+	ts, err := loadTenants(f.Name())
+	require.NoError(t, err)
+
+	html := `<html><head><script>app()</script><script type="text/template"></script></head><body></body></html>`
+	r := new(MockRenderer)
+	r.On("Render", "https://www.netlify.com/").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	r.On("Render", "https://netlify.org/").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	a := &app{renderer: r, tenants: ts}
+
+	for u, expected := range map[string]string{
+		"https://www.netlify.com/": `<html><head><script type="text/template"></script></head><body></body></html>`,
+		// the processor is only enabled for the hosts it lists
+		"https://netlify.org/": html,
+	} {
+		req := httptest.NewRequest("GET", "/"+u, nil)
+		req.Header.Set("X-Prerender-Token", "acmetoken")
+		w := httptest.NewRecorder()
+		a.serve(w, req)
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		assert.Equal(t, expected, string(body))
+	}
+	r.AssertExpectations(t)
+
+	f, err = ioutil.TempFile("", "tenants")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"tenants": [{"name": "acme", "tokens": ["acmetoken"], "processors": [{"name": "nope"}]}]}`)
+	f.Close()
+	_, err = loadTenants(f.Name())
+	assert.EqualError(t, err, `tenant acme: unknown processor "nope", available: absolutize, minify, softErrors, statusCode, stripScripts, validateJsonLd`)
+}
+
+func TestProxyMode(t *testing.T) {
+	host := "www.example.com"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, host, r.Host)
+		assert.Equal(t, host, r.Header.Get("X-Forwarded-Host"))
+		fmt.Fprintf(w, "origin %s", r.URL.RequestURI())
+	}))
+	defer upstream.Close()
+
+	p, err := newProxy(config.Proxy{Upstream: upstream.URL, Scheme: "https", Hosts: []string{"*.example.com"}})
+	require.NoError(t, err)
+	r := new(MockRenderer)
+	a := &app{renderer: r, proxy: p, tenants: testTenants(t)}
+	serve := func(path, ua string) *http.Response {
+		req := httptest.NewRequest("GET", "http://"+host+path, nil)
+		req.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		a.serveProxy(w, req)
+		return w.Result()
+	}
+
+	// crawlers get the rendered page, without authenticating
+	r.On("Render", "https://www.example.com/products?id=1").Return(nil, http.StatusOK, "<html>rendered</html>", "etagetag", 1).Once()
+	resp := serve("/products?id=1", "Googlebot/2.1")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<html>rendered</html>", string(body))
+
+	// other requests, including the API of the service, reach the origin
+	for _, test := range []struct{ path, ua string }{
+		{"/products?id=1", "Mozilla/5.0 Chrome/120.0"},
+		{"/app.js", "Googlebot/2.1"},
+		{"/render?url=https://example.com/", "Mozilla/5.0 Chrome/120.0"},
+	} {
+		resp = serve(test.path, test.ua)
+		body, _ = ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "origin "+test.path, string(body))
+	}
+
+	// the origin serves crawlers when rendering fails
+	r.On("Render", "https://www.example.com/broken").Return(errors.New("chrome crashed")).Once()
+	resp = serve("/broken", "Googlebot/2.1")
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "origin /broken", string(body))
+	r.AssertExpectations(t)
+
+	resp = serve("/healthz", "kube-probe/1.27")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// pages of other hosts aren't rendered
+	host = "www.example.org"
+	resp = serve("/", "Googlebot/2.1")
+	body, _ = ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "origin /", string(body))
+	r.AssertExpectations(t)
+}
+
+func TestRenderTo(t *testing.T) {
+	r := new(MockRenderer)
+	pipeline, err := process.NewPipeline(config.Default().ProcessorSteps())
+	require.NoError(t, err)
+	a := &app{renderer: r, pipeline: pipeline}
+
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html><head><title>Netlify</title></head><body><script>app()</script></body></html>", "etagetag", 1).Once()
+	opts, err := parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/", "format": "json"}[name]
+	})
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, a.renderTo(&out, opts))
+	var res render.Result
+	require.NoError(t, json.Unmarshal(out.Bytes(), &res))
+	// processed like the pages of the server
+	assert.Equal(t, "<html><head><title>Netlify</title></head><body></body></html>", res.HTML)
+	assert.Equal(t, "Netlify", res.Meta.Title)
+
+	r.On("Render", "https://netlify.com/missing").Return(nil, http.StatusNotFound, "<html>not found</html>", "", 1).Once()
+	opts, err = parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/missing"}[name]
+	})
+	require.NoError(t, err)
+	out.Reset()
+	assert.EqualError(t, a.renderTo(&out, opts), "page responded 404")
+	assert.Equal(t, "<html>not found</html>", out.String())
+
+	r.On("Render", "https://netlify.com/missing").Return(render.ErrPageLoadTimeout).Once()
+	assert.Error(t, a.renderTo(&out, opts))
+	r.AssertExpectations(t)
+}
+
+func TestRenderCommandUsage(t *testing.T) {
+	assert.Equal(t, 2, renderCommand(nil))
+	assert.Equal(t, 2, renderCommand([]string{"-format", "xml", "https://netlify.com/"}))
+	assert.Equal(t, 2, renderCommand([]string{"/relative"}))
+}
+
+func TestCacheCommand(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := cache.NewCache(config.Cache{Backend: "redis", RedisURL: "redis://" + s.Addr()})
+	require.NoError(t, err)
+	run := func(stdin string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runCacheCommand(c, args, strings.NewReader(stdin), &out)
+		return out.String(), err
+	}
+
+	out, err := run(`{"url":"https://netlify.com/","status":200,"etag":"etagetag","html":"<html></html>"}
+
+{"url":"https://netlify.com/blog","status":404,"headers":{"X-Robots-Tag":["noindex"]},"html":"<html>gone</html>","ttl":60000000000}
+{"url":"https://example.com/","html":"<html>example</html>"}
+`, "import")
+	require.NoError(t, err)
+	assert.Equal(t, "3 pages imported\n", out)
+	assert.Equal(t, time.Minute, s.TTL("https://netlify.com/blog"))
+	assert.Equal(t, 24*time.Hour, s.TTL("https://example.com/"))
+
+	out, err = run("", "get", "https://netlify.com/blog")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"url": "https://netlify.com/blog", "key": "https://netlify.com/blog", "size": 17, "ttl": 60000000000,
+		"status": 404, "headers": {"X-Robots-Tag": ["noindex"]}, "html": "<html>gone</html>"}`, out)
+	out, err = run("", "get", "-html", "https://netlify.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "<html></html>", out)
+	_, err = run("", "get", "https://netlify.com/missing")
+	assert.EqualError(t, err, "https://netlify.com/missing is not cached")
+
+	out, err = run("", "ls", "--prefix", "https://netlify.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "URL                       SIZE  TTL\nhttps://netlify.com/      13    24h0m0s\nhttps://netlify.com/blog  17    1m0s\n", sortLines(out))
+
+	out, err = run("", "stats")
+	require.NoError(t, err)
+	assert.Equal(t, "HOST         PAGES  SIZE\nnetlify.com  2      30\nexample.com  1      20\ntotal        3      50\n", out)
+
+	out, err = run("", "export", "-prefix", "https://example.com/")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"url": "https://example.com/", "status": 200, "html": "<html>example</html>", "ttl": 86400000000000}`, out)
+
+	out, err = run("", "rm", "-prefix", "https://netlify.com/")
+	require.NoError(t, err)
+	assert.Equal(t, "2 pages removed\n", out)
+	_, err = run("", "rm", "https://example.com/")
+	require.NoError(t, err)
+	assert.Empty(t, s.Keys())
+
+	_, err = run("", "rm")
+	assert.IsType(t, usageError(""), err)
+	_, err = run("", "purge")
+	assert.IsType(t, usageError(""), err)
+	_, err = run("{not json}\n", "import")
+	assert.EqualError(t, err, "line 1: invalid character 'n' looking for beginning of object key string")
+}
+
+func TestCacheExportImport(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := cache.NewCache(config.Cache{Backend: "redis", RedisURL: "redis://" + s.Addr()})
+	require.NoError(t, err)
+	run := func(stdin string, args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runCacheCommand(c, args, strings.NewReader(stdin), &out)
+		return out.String(), err
+	}
+
+	_, err = run(`{"url":"https://netlify.com/","status":200,"html":"<html></html>","ttl":0}
+{"url":"https://netlify.com/blog","status":200,"html":"<html>blog</html>","ttl":3600000000000}
+`, "import", "-ttl", "1m")
+	require.NoError(t, err)
+	assert.True(t, s.Exists("https://netlify.com/"))
+	assert.Equal(t, time.Duration(0), s.TTL("https://netlify.com/"))
+	assert.Equal(t, time.Hour, s.TTL("https://netlify.com/blog"))
+
+	export, err := run("", "export")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(export, "\n"), "\n")
+	sort.Strings(lines)
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"url": "https://netlify.com/", "status": 200, "html": "<html></html>", "ttl": 0}`, lines[0])
+	assert.JSONEq(t, `{"url": "https://netlify.com/blog", "status": 200, "html": "<html>blog</html>", "ttl": 3600000000000}`, lines[1])
+
+	s.FlushAll()
+	out, err := run(export, "import", "-ttl", "1m")
+	require.NoError(t, err)
+	assert.Equal(t, "2 pages imported\n", out)
+	assert.True(t, s.Exists("https://netlify.com/"))
+	assert.Equal(t, time.Duration(0), s.TTL("https://netlify.com/"))
+	assert.Equal(t, time.Hour, s.TTL("https://netlify.com/blog"))
+}
+
+// sortLines sorts the lines of a listing after its header, entries are
+// listed in no particular order
+func sortLines(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	sort.Strings(lines[1:])
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestDebugHeaders(t *testing.T) {
+	opts, err := parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/", "debug": "1"}[name]
+	})
+	require.NoError(t, err)
+	assert.True(t, opts.Debug)
+
+	h := http.Header{}
+	setDebugHeaders(h, &render.Result{
+		Exceptions: []render.Exception{{Message: "TypeError: Cannot read properties of undefined (reading 'map')", Stack: "    at App (app.js:1:2)"}},
+		Console: []render.ConsoleMessage{
+			{Level: "log", Source: "console", Text: "started"},
+			{Level: "error", Source: "network", Text: "Failed to load resource:\n the server responded with a status of 500"},
+			{Level: "error", Source: "console", Text: strings.Repeat("é", 150)},
+		},
+	})
+	assert.Equal(t, "3", h.Get("X-Prerender-Errors"))
+	require.Len(t, h["X-Prerender-Error"], 3)
+	assert.Equal(t, "TypeError: Cannot read properties of undefined (reading 'map')", h["X-Prerender-Error"][0])
+	assert.Equal(t, "Failed to load resource: the server responded with a status of 500", h["X-Prerender-Error"][1])
+	assert.Equal(t, strings.Repeat("é", 100)+"...", h["X-Prerender-Error"][2])
+
+	h = http.Header{}
+	setDebugHeaders(h, &render.Result{})
+	assert.Equal(t, "0", h.Get("X-Prerender-Errors"))
+}
+
+func TestHAROptions(t *testing.T) {
+	opts, err := parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/", "format": "har"}[name]
+	})
+	require.NoError(t, err)
+	assert.True(t, opts.Render.HAR)
+	assert.True(t, opts.Refresh)
+
+	opts, err = parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/", "format": "json", "har": "true"}[name]
+	})
+	require.NoError(t, err)
+	assert.True(t, opts.Render.HAR)
+	assert.Equal(t, formatJSON, opts.Format)
+
+	opts, err = parseOptions(func(name string) string {
+		return map[string]string{"url": "https://netlify.com/"}[name]
+	})
+	require.NoError(t, err)
+	assert.False(t, opts.Render.HAR)
+	assert.False(t, opts.Refresh)
+
+	w := httptest.NewRecorder()
+	writeResult(&render.Result{
+		URL:    "https://netlify.com/",
+		Status: http.StatusOK,
+		HTML:   "<html></html>",
+		HAR:    &render.HAR{Log: render.HARLog{Version: "1.2", Entries: []render.HAREntry{{Request: render.HARRequest{URL: "https://netlify.com/"}}}}},
+	}, nil, w, formatHAR)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var har render.HAR
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &har))
+	assert.Equal(t, "1.2", har.Log.Version)
+	require.Len(t, har.Log.Entries, 1)
+	assert.Equal(t, "https://netlify.com/", har.Log.Entries[0].Request.URL)
+}
+
+// harRenderer adds an empty HAR to the results of a MockRenderer
+type harRenderer struct {
+	MockRenderer
+}
+
+func (r *harRenderer) Render(req *http.Request) (*render.Result, error) {
+	res, err := r.MockRenderer.Render(req)
+	if res != nil {
+		res.FinalURL = res.URL
+		res.HAR = &render.HAR{Log: render.HARLog{Pages: []render.HARPage{{Title: res.FinalURL}}}}
+	}
+	return res, err
+}
+
+func TestHARTitle(t *testing.T) {
+	r := new(harRenderer)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, "<html><head><title>Netlify</title></head></html>", "etagetag", 1).Once()
+	r.On("Render", "https://netlify.com/blog").Return(nil, http.StatusOK, "<html></html>", "etagetag", 1).Once()
+
+	req := httptest.NewRequest("GET", "https://netlify.com/", nil)
+	res, err := getData(req.WithContext(setRenderer(req.Context(), r)))
+	require.NoError(t, err)
+	assert.Equal(t, "Netlify", res.Meta.Title)
+	assert.Equal(t, "Netlify", res.HAR.Log.Pages[0].Title)
+
+	// pages without a title keep their URL
+	req = httptest.NewRequest("GET", "https://netlify.com/blog", nil)
+	res, err = getData(req.WithContext(setRenderer(req.Context(), r)))
+	require.NoError(t, err)
+	assert.Equal(t, "https://netlify.com/blog", res.HAR.Log.Pages[0].Title)
+	r.AssertExpectations(t)
+}
+
+func TestMetaEndpoint(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	pipeline, err := process.NewPipeline(config.Default().ProcessorSteps())
+	require.NoError(t, err)
+	html := `<html><head><title>Netlify</title><meta name="robots" content="noindex"></head><body><h1>Deploy</h1></body></html>`
+
+	req := httptest.NewRequest("GET", "/meta?url=https%3A%2F%2Fnetlify.com%2F", nil)
+	ctx := setRenderer(req.Context(), r)
+	ctx = setCache(ctx, c)
+	ctx = setPipeline(ctx, pipeline)
+	w := httptest.NewRecorder()
+	c.On("Check", mock.Anything).Return(nil, 0, "", "", 0).Once()
+	c.On("Save", mock.MatchedBy(func(res *render.Result) bool {
+		// the metadata is cached with the page
+		return res.Meta != nil && res.Meta.Robots == "noindex"
+	}), 24*time.Hour).Return(nil).Once()
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, html, "etagetag", 1).Once()
+	handle(w, req.WithContext(ctx))
+
+	r.AssertExpectations(t)
+	c.AssertExpectations(t)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp pageMetaResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "https://netlify.com/", resp.URL)
+	assert.False(t, resp.Cached)
+	assert.Equal(t, "Netlify", resp.Meta.Title)
+	assert.Equal(t, []string{"Deploy"}, resp.Meta.H1)
+	assert.NotContains(t, w.Body.String(), "<html>")
+
+	// cached pages saved without metadata have it extracted
+	w = httptest.NewRecorder()
+	c.On("Check", mock.Anything).Return(nil, http.StatusOK, html, "etagetag", 0).Once()
+	handle(w, req.WithContext(ctx))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Cached)
+	assert.Equal(t, "noindex", resp.Meta.Robots)
+
+	w = httptest.NewRecorder()
+	handle(w, httptest.NewRequest("GET", "/meta?url=netlify.com", nil).WithContext(ctx))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestStructuredDataFormat(t *testing.T) {
+	r := new(MockRenderer)
+	c := new(MockCache)
+	html := `<html><head><script type="application/ld+json">{"@context": "https://schema.org", "@type": "Product", "name": "Shoes",}</script></head></html>`
+
+	req := httptest.NewRequest("GET", "/render?url=https%3A%2F%2Fnetlify.com%2F&format=jsonld", nil)
+	ctx := setRenderer(req.Context(), r)
+	ctx = setCache(ctx, c)
+	w := httptest.NewRecorder()
+	// cached pages are validated too
+	c.On("Check", mock.Anything).Return(nil, http.StatusOK, html, "etagetag", 0).Once()
+	handle(w, req.WithContext(ctx))
+
+	r.AssertNotCalled(t, "Render", mock.Anything)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var resp struct {
+		Cached bool `json:"cached"`
+		Valid  bool `json:"valid"`
+		Errors int  `json:"errors"`
+		Blocks []struct {
+			Line   int      `json:"line"`
+			Errors []string `json:"errors"`
+		} `json:"blocks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.Cached)
+	assert.False(t, resp.Valid)
+	assert.Equal(t, 1, resp.Errors)
+	require.Len(t, resp.Blocks, 1)
+	assert.Contains(t, resp.Blocks[0].Errors[0], "syntax error at line 1, column 72")
+
+	var res render.Result
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Empty(t, res.HTML)
+}
+
+func TestContentChanges(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	c, err := cache.NewCache(config.Cache{Backend: "redis", RedisURL: "redis://" + s.Addr()})
+	require.NoError(t, err)
+
+	posted := make(chan changes.Change, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change changes.Change
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&change))
+		posted <- change
+	}))
+	defer hook.Close()
+	d, err := changes.New(config.Changes{Webhook: hook.URL, Ignore: []string{"time"}})
+	require.NoError(t, err)
+
+	r := new(MockRenderer)
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, `<html><head><title>Netlify</title></head><body><time>1</time></body></html>`, "", 1).Once()
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, `<html><head><title>Netlify</title></head><body><time>2</time></body></html>`, "", 1).Once()
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, `<html><head></head><body><time>3</time></body></html>`, "", 1).Once()
+	rerender := func() {
+		req := httptest.NewRequest("GET", "/https://netlify.com/", nil)
+		req.Header.Set("X-Prerender-Refresh", "true")
+		ctx := setRenderer(req.Context(), r)
+		ctx = setCache(ctx, c)
+		ctx = setChanges(ctx, d)
+		w := httptest.NewRecorder()
+		handle(w, req.WithContext(ctx))
+		assert.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, d.Drain(context.Background()))
+	}
+
+	// nothing to compare the first render with, then only volatile
+	// content changes
+	rerender()
+	rerender()
+	select {
+	case change := <-posted:
+		t.Fatalf("unexpected change posted: %+v", change)
+	default:
+	}
+
+	rerender()
+	select {
+	case change := <-posted:
+		assert.Equal(t, "https://netlify.com/", change.URL)
+		assert.Equal(t, []string{"title: Netlify"}, change.Diff.Removed)
+	default:
+		t.Fatal("no change posted")
+	}
+
+	// the snapshot outlives the cached page
+	s.FastForward(25 * time.Hour)
+	assert.False(t, s.Exists("https://netlify.com/"))
+	assert.True(t, s.Exists("prerender:snapshot:https://netlify.com/"))
+	r.On("Render", "https://netlify.com/").Return(nil, http.StatusOK, `<html><head><title>Netlify</title></head><body></body></html>`, "", 1).Once()
+	rerender()
+	r.AssertExpectations(t)
+	select {
+	case change := <-posted:
+		assert.Equal(t, []string{"title: Netlify"}, change.Diff.Added)
+	default:
+		t.Fatal("no change posted after the page expired")
+	}
+	assert.Equal(t, changes.SnapshotTTL, s.TTL("prerender:snapshot:https://netlify.com/"))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/render"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	renderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prerender_render_duration_seconds",
+		Help:    "Time spent rendering pages in Chrome, by response status.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+	}, []string{"status"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prerender_cache_requests_total",
+		Help: "Cache lookups by backend and result.",
+	}, []string{"backend", "result"})
+	blockedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prerender_blocked_requests_total",
+		Help: "Subresource requests blocked while rendering pages.",
+	})
+	contentChanges = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prerender_content_changes_total",
+		Help: "Renders whose content changed from their previous render.",
+	})
+	htmlSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "prerender_html_size_bytes",
+		Help:    "Size of the rendered HTML.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(renderDuration, cacheRequests, blockedRequests, contentChanges, htmlSize)
+}
+
+// registerJobQueue exposes the number of jobs waiting for a worker
+func registerJobQueue(runner *jobRunner) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "prerender_job_queue_depth",
+		Help: "Number of jobs waiting for a worker.",
+	}, func() float64 {
+		return float64(len(runner.queue))
+	}))
+}
+
+// cacheBackend names the backend of c for the metric labels
+func cacheBackend(c cache.Cache) string {
+	switch c.(type) {
+	case *cache.RedisCache:
+		return "redis"
+	case *cache.S3Cache:
+		return "s3"
+	default:
+		return "other"
+	}
+}
+
+// observeRender records a render done by Chrome, res is nil if it failed
+func observeRender(res *render.Result, err error, start time.Time) {
+	if err != nil {
+		status := "error"
+		if err == render.ErrPageLoadTimeout {
+			status = "timeout"
+		}
+		renderDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+		return
+	}
+	renderDuration.WithLabelValues(strconv.Itoa(res.Status)).Observe(res.Duration.Seconds())
+	blockedRequests.Add(float64(res.BlockedRequests))
+	if res.HTML != "" {
+		htmlSize.Observe(float64(len(res.HTML)))
+	}
+}
@@ -0,0 +1,325 @@
+// Package middleware serves prerendered pages to crawlers from Go web
+// servers. Like the prerender.io middlewares, it detects the requests of
+// crawlers and fetches their page from a prerender service, or renders
+// it in-process, while every other request goes to the wrapped handler.
+//
+//	p := middleware.New(middleware.Options{
+//		ServiceURL: "http://prerender:8000",
+//		Token:      os.Getenv("PRERENDER_TOKEN"),
+//	})
+//	http.ListenAndServe(":8080", p.Handler(app))
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+)
+
+// CrawlerUserAgents are the default user agents, matched as
+// case-insensitive substrings, of the crawlers served prerendered pages
+var CrawlerUserAgents = []string{
+	"googlebot",
+	"google-inspectiontool",
+	"google page speed",
+	"chrome-lighthouse",
+	"bingbot",
+	"yahoo! slurp",
+	"yandex",
+	"baiduspider",
+	"duckduckbot",
+	"applebot",
+	"seznambot",
+	"qwantify",
+	"facebookexternalhit",
+	"twitterbot",
+	"linkedinbot",
+	"pinterest",
+	"slackbot",
+	"discordbot",
+	"telegrambot",
+	"whatsapp",
+	"skypeuripreview",
+	"vkshare",
+	"redditbot",
+	"embedly",
+	"quora link preview",
+	"showyoubot",
+	"outbrain",
+	"flipboard",
+	"tumblr",
+	"bitlybot",
+	"nuzzel",
+	"bitrix link preview",
+	"xing-contenttabreceiver",
+	"w3c_validator",
+	"rogerbot",
+	"ahrefsbot",
+	"screaming frog seo spider",
+}
+
+// IgnoredExtensions are the default extensions of the static assets,
+// which are never prerendered
+var IgnoredExtensions = []string{
+	".js", ".mjs", ".css", ".less", ".map", ".json", ".xml", ".rss", ".txt", ".webmanifest",
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico", ".tif", ".psd", ".ai",
+	".woff", ".woff2", ".ttf", ".otf", ".eot",
+	".mp3", ".mp4", ".m4a", ".m4v", ".wav", ".avi", ".mov", ".mpg", ".mpeg", ".wmv", ".flv", ".webm", ".swf",
+	".pdf", ".doc", ".docx", ".xls", ".xlsx", ".ppt", ".pptx",
+	".zip", ".rar", ".gz", ".tar", ".dmg", ".iso", ".exe", ".dat", ".torrent",
+}
+
+// DefaultTimeout bounds the requests to the prerender service when
+// Options.Timeout isn't set
+const DefaultTimeout = 30 * time.Second
+
+// Options configure the middleware. Either ServiceURL or Renderer must be
+// set
+type Options struct {
+	// ServiceURL is the URL of the prerender service, pages are fetched
+	// from its path API
+	ServiceURL string
+	// Token is sent to the service in the X-Prerender-Token header
+	Token string
+	// Timeout bounds the requests to the service, defaults to
+	// DefaultTimeout. The requests that time out are served by the
+	// wrapped handler
+	Timeout time.Duration
+	// Client makes the requests to the service, Timeout is ignored when
+	// it is set
+	Client *http.Client
+
+	// Renderer renders the pages in-process rather than through the
+	// service, for small apps not running one. Pages are then neither
+	// cached nor rate limited
+	Renderer render.Renderer
+	// Pipeline processes the pages rendered by Renderer
+	Pipeline *process.Pipeline
+	// RenderOptions tune the pages rendered by Renderer
+	RenderOptions render.Options
+
+	// CrawlerUserAgents replaces the default CrawlerUserAgents
+	CrawlerUserAgents []string
+	// IgnoredExtensions replaces the default IgnoredExtensions
+	IgnoredExtensions []string
+
+	// Scheme and Host override those of the incoming requests in the
+	// rendered URL, e.g. behind a proxy
+	Scheme string
+	Host   string
+	// Hosts are the hosts of the app, as exact names or path.Match
+	// patterns like *.example.com. The Host header is up to the client,
+	// so without Host, Renderer only renders the requests for one of
+	// Hosts, the others are served by the wrapped handler
+	Hosts []string
+}
+
+// Prerender is the middleware
+type Prerender struct {
+	opts       Options
+	client     *http.Client
+	crawlers   []string
+	extensions map[string]bool
+}
+
+// New creates the middleware
+func New(o Options) *Prerender {
+	p := &Prerender{opts: o, client: o.Client, extensions: map[string]bool{}}
+	if p.client == nil {
+		timeout := o.Timeout
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		p.client = &http.Client{Timeout: timeout}
+	}
+	crawlers := o.CrawlerUserAgents
+	if crawlers == nil {
+		crawlers = CrawlerUserAgents
+	}
+	for _, ua := range crawlers {
+		p.crawlers = append(p.crawlers, strings.ToLower(ua))
+	}
+	extensions := o.IgnoredExtensions
+	if extensions == nil {
+		extensions = IgnoredExtensions
+	}
+	for _, ext := range extensions {
+		p.extensions[strings.ToLower(ext)] = true
+	}
+	return p
+}
+
+// Handler serves prerendered pages to crawlers, and passes the other
+// requests to next. Crawlers are served by next as well when the page
+// can't be prerendered
+func (p *Prerender) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.ShouldPrerender(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var err error
+		if p.opts.Renderer != nil {
+			err = p.render(w, r)
+		} else {
+			err = p.proxy(w, r)
+		}
+		if err != nil {
+			log.Printf("prerender %s failed, serving it normally: %s\n", p.URL(r), err)
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// ShouldPrerender tells whether r is made by a crawler for a page rather
+// than a static asset
+func (p *Prerender) ShouldPrerender(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	ua := strings.ToLower(r.UserAgent())
+	// the renderer sets X-Prerender, its requests must reach the app
+	if ua == "" || r.Header.Get("X-Prerender") != "" {
+		return false
+	}
+	if p.extensions[strings.ToLower(path.Ext(r.URL.Path))] {
+		return false
+	}
+	if _, ok := r.URL.Query()["_escaped_fragment_"]; ok {
+		return true
+	}
+	if r.Header.Get("X-Bufferbot") != "" {
+		return true
+	}
+	for _, crawler := range p.crawlers {
+		if strings.Contains(ua, crawler) {
+			return true
+		}
+	}
+	return false
+}
+
+// URL returns the URL of the page requested by r
+func (p *Prerender) URL(r *http.Request) string {
+	scheme := p.opts.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if r.TLS != nil {
+			scheme = "https"
+		} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+	}
+	host := p.opts.Host
+	if host == "" {
+		host = r.Host
+	}
+	return scheme + "://" + host + r.URL.RequestURI()
+}
+
+// hostAllowed tells whether the page of r may be rendered in-process:
+// either its host is set by Options.Host, or it is one of Options.Hosts
+func (p *Prerender) hostAllowed(r *http.Request) bool {
+	if p.opts.Host != "" {
+		return true
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return len(p.opts.Hosts) > 0 && guard.MatchHost(p.opts.Hosts, host)
+}
+
+// errUnavailable is returned for the responses of the service which
+// should rather be served by the app
+type errUnavailable int
+
+func (e errUnavailable) Error() string {
+	return fmt.Sprintf("prerender service responded %d", int(e))
+}
+
+// proxy copies the response of the service for the page of r
+func (p *Prerender) proxy(w http.ResponseWriter, r *http.Request) error {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.opts.ServiceURL, "/")+"/"+p.URL(r), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating request failed")
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Set("User-Agent", r.UserAgent())
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if p.opts.Token != "" {
+		req.Header.Set("X-Prerender-Token", p.opts.Token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "requesting prerender service failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusUnauthorized {
+		return errUnavailable(resp.StatusCode)
+	}
+
+	for name, values := range resp.Header {
+		if name == "Content-Length" || name == "Connection" {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return nil
+}
+
+// render renders the page of r with the in-process renderer
+func (p *Prerender) render(w http.ResponseWriter, r *http.Request) error {
+	if !p.hostAllowed(r) {
+		return errors.Errorf("host %s is not one of the hosts of the app", r.Host)
+	}
+	ctx := render.WithOptions(r.Context(), p.opts.RenderOptions)
+	req, err := http.NewRequest(http.MethodGet, p.URL(r), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating request failed")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", r.UserAgent())
+
+	res, err := p.opts.Renderer.Render(req)
+	if err != nil {
+		return err
+	}
+	if res.Status >= 500 {
+		return errUnavailable(res.Status)
+	}
+	if res.Status == http.StatusOK {
+		if err := p.opts.Pipeline.Process(r.Context(), res); err != nil {
+			return err
+		}
+	}
+
+	for name, values := range res.Headers {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(res.Status)
+	if r.Method != http.MethodHead {
+		io.WriteString(w, res.HTML)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/process"
+	"github.com/Mixelito/prerender/render"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const googlebot = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+
+var app = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("app"))
+})
+
+func TestShouldPrerender(t *testing.T) {
+	p := New(Options{ServiceURL: "http://prerender"})
+	for _, test := range []struct {
+		method, url, ua string
+		header          http.Header
+		expected        bool
+	}{
+		{"GET", "/", googlebot, nil, true},
+		{"HEAD", "/products/1", "facebookexternalhit/1.1", nil, true},
+		{"GET", "/", "Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0", nil, false},
+		{"GET", "/?_escaped_fragment_=", "Mozilla/5.0 Chrome/120.0", nil, true},
+		{"GET", "/", "Mozilla/5.0", http.Header{"X-Bufferbot": {"1"}}, true},
+		{"GET", "/", "", nil, false},
+		{"POST", "/", googlebot, nil, false},
+		{"GET", "/static/app.JS", googlebot, nil, false},
+		{"GET", "/logo.png?v=2", googlebot, nil, false},
+		// requests of the renderer itself
+		{"GET", "/", googlebot, http.Header{"X-Prerender": {"1"}}, false},
+	} {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		for name, values := range test.header {
+			r.Header[name] = values
+		}
+		r.Header.Set("User-Agent", test.ua)
+		assert.Equal(t, test.expected, p.ShouldPrerender(r), "%s %s %s", test.method, test.url, test.ua)
+	}
+
+	p = New(Options{CrawlerUserAgents: []string{"MyBot"}, IgnoredExtensions: []string{}})
+	r := httptest.NewRequest("GET", "/app.js", nil)
+	r.Header.Set("User-Agent", "mybot/1.0")
+	assert.True(t, p.ShouldPrerender(r))
+	r.Header.Set("User-Agent", googlebot)
+	assert.False(t, p.ShouldPrerender(r))
+}
+
+func TestURL(t *testing.T) {
+	p := New(Options{})
+	r := httptest.NewRequest("GET", "http://example.com/a?b=c", nil)
+	assert.Equal(t, "http://example.com/a?b=c", p.URL(r))
+	r.Header.Set("X-Forwarded-Proto", "https, http")
+	assert.Equal(t, "https://example.com/a?b=c", p.URL(r))
+
+	p = New(Options{Scheme: "https", Host: "www.example.com"})
+	assert.Equal(t, "https://www.example.com/a?b=c", p.URL(r))
+}
+
+func TestProxy(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/http://example.com/products?id=1", r.URL.RequestURI())
+		assert.Equal(t, "secret", r.Header.Get("X-Prerender-Token"))
+		assert.Equal(t, googlebot, r.UserAgent())
+		w.Header().Set("Etag", `"abc"`)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html>not found</html>"))
+	}))
+	defer service.Close()
+
+	p := New(Options{ServiceURL: service.URL + "/", Token: "secret"})
+	r := httptest.NewRequest("GET", "http://example.com/products?id=1", nil)
+	r.Header.Set("User-Agent", googlebot)
+	w := httptest.NewRecorder()
+	p.Handler(app).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, `"abc"`, w.Header().Get("Etag"))
+	assert.Equal(t, "<html>not found</html>", w.Body.String())
+
+	// browsers get the app
+	r = httptest.NewRequest("GET", "http://example.com/products?id=1", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 Chrome/120.0")
+	w = httptest.NewRecorder()
+	p.Handler(app).ServeHTTP(w, r)
+	assert.Equal(t, "app", w.Body.String())
+}
+
+func TestProxyFallback(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/http://example.com/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}))
+	defer service.Close()
+
+	p := New(Options{ServiceURL: service.URL, Timeout: 50 * time.Millisecond})
+	for _, path := range []string{"/slow", "/timeout"} {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		r.Header.Set("User-Agent", googlebot)
+		w := httptest.NewRecorder()
+		p.Handler(app).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "app", w.Body.String(), path)
+	}
+
+	// the service is down
+	p = New(Options{ServiceURL: "http://127.0.0.1:1"})
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("User-Agent", googlebot)
+	w := httptest.NewRecorder()
+	p.Handler(app).ServeHTTP(w, r)
+	assert.Equal(t, "app", w.Body.String())
+}
+
+type fakeRenderer struct {
+	res *render.Result
+	err error
+	req *http.Request
+}
+
+func (f *fakeRenderer) Render(r *http.Request) (*render.Result, error) {
+	f.req = r
+	return f.res, f.err
+}
+
+func (f *fakeRenderer) SetPageLoadTimeout(time.Duration) {}
+func (f *fakeRenderer) Close()                           {}
+
+func TestInProcess(t *testing.T) {
+	pipeline, err := process.NewPipeline([]config.Processor{{Name: "statusCode"}})
+	require.NoError(t, err)
+	renderer := &fakeRenderer{res: &render.Result{
+		Status: http.StatusOK,
+		HTML:   `<html><head><meta name="prerender-status-code" content="410"></head><body>gone</body></html>`,
+	}}
+	p := New(Options{Renderer: renderer, Pipeline: pipeline, RenderOptions: render.Options{Wait: time.Second}, Hosts: []string{"example.com"}})
+
+	r := httptest.NewRequest("GET", "http://example.com/old", nil)
+	r.Header.Set("User-Agent", googlebot)
+	w := httptest.NewRecorder()
+	p.Handler(app).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusGone, w.Code)
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, `<html><head></head><body>gone</body></html>`, string(body))
+	assert.Equal(t, "http://example.com/old", renderer.req.URL.String())
+	assert.Equal(t, googlebot, renderer.req.UserAgent())
+	assert.Equal(t, time.Second, render.GetOptions(renderer.req.Context()).Wait)
+
+	renderer.err = errors.New("chrome crashed")
+	w = httptest.NewRecorder()
+	p.Handler(app).ServeHTTP(w, r)
+	assert.Equal(t, "app", w.Body.String())
+}
+
+func TestInProcessHosts(t *testing.T) {
+	renderer := &fakeRenderer{res: &render.Result{Status: http.StatusOK, HTML: "<html>rendered</html>"}}
+	serve := func(o Options, host string) string {
+		renderer.req = nil
+		o.Renderer = renderer
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Host = host
+		r.Header.Set("User-Agent", googlebot)
+		w := httptest.NewRecorder()
+		New(o).Handler(app).ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	// the Host header can point the renderer anywhere
+	assert.Equal(t, "app", serve(Options{}, "169.254.169.254"))
+	assert.Nil(t, renderer.req)
+	assert.Equal(t, "app", serve(Options{Hosts: []string{"example.com", "*.example.com"}}, "169.254.169.254"))
+	assert.Nil(t, renderer.req)
+
+	assert.Equal(t, "<html>rendered</html>", serve(Options{Hosts: []string{"example.com", "*.example.com"}}, "www.example.com:8080"))
+	assert.Equal(t, "http://www.example.com:8080/", renderer.req.URL.String())
+	assert.Equal(t, "<html>rendered</html>", serve(Options{Host: "example.com"}, "169.254.169.254"))
+	assert.Equal(t, "http://example.com/", renderer.req.URL.String())
+}
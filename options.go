@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/render"
+)
+
+var (
+	errURLRequired = errors.New("url is required")
+	errInvalidURL  = errors.New("Invalid URL")
+)
+
+// renderOptions are the per-request options shared by every API shape:
+// the query parameters of /render, the X-Prerender-* headers of the
+// legacy path API, and the options of jobs and batches
+type renderOptions struct {
+	URL     *url.URL
+	Format  string
+	Refresh bool
+	// Debug adds the errors of the page to the response headers
+	Debug  bool
+	Render render.Options
+}
+
+// parseOptions reads the options through get, which returns the raw value
+// of an option by name
+func parseOptions(get func(name string) string) (*renderOptions, error) {
+	opts := &renderOptions{Format: formatHTML}
+
+	raw := get("url")
+	if raw == "" {
+		return nil, errURLRequired
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() {
+		return nil, errInvalidURL
+	}
+
+	//http://www.example.com?_escaped_fragment_=key1=value1%26key2=value2
+	//to http://www.example.com#!key1=value1&key2=value2
+	// Remove the _escaped_fragment_ query parameter
+	urlQuery := u.Query()
+	if urlQuery != nil && urlQuery["_escaped_fragment_"] != nil {
+
+		if urlQuery.Get("_escaped_fragment_") != "" {
+			u.Path = "#!" + urlQuery.Get("_escaped_fragment_")
+		}
+
+		urlQuery.Del("_escaped_fragment_")
+		u.RawQuery = urlQuery.Encode()
+	}
+	opts.URL = u
+
+	if f := strings.ToLower(get("format")); f != "" {
+		if f != formatHTML && f != formatJSON && f != formatHAR && f != formatMeta && f != formatJSONLD {
+			return nil, errors.New("invalid format: " + f)
+		}
+		opts.Format = f
+	}
+	if opts.Render.Wait, err = config.ParseDuration(get("wait")); err != nil {
+		return nil, errors.New("invalid wait: " + get("wait"))
+	}
+	if opts.Render.Timeout, err = config.ParseDuration(get("timeout")); err != nil {
+		return nil, errors.New("invalid timeout: " + get("timeout"))
+	}
+	opts.Render.UserAgent = get("userAgent")
+	opts.Refresh = get("refresh") == "true" || get("refresh") == "1"
+	opts.Debug = get("debug") == "true" || get("debug") == "1"
+	opts.Render.HAR = opts.Format == formatHAR || get("har") == "true" || get("har") == "1"
+	if opts.Render.HAR {
+		// only a render records a HAR
+		opts.Refresh = true
+	}
+	return opts, nil
+}
+
+// queryOptions reads the options of GET /render?url=...
+func queryOptions(r *http.Request) (*renderOptions, error) {
+	return parseOptions(tenantDefaults(r, r.URL.Query().Get))
+}
+
+// legacyOptions reads the options of the path API, where the URL to render
+// is the whole path and query of the request. Its query string belongs to
+// that URL, so options are passed as X-Prerender-* headers instead
+func legacyOptions(r *http.Request) (*renderOptions, error) {
+	// RequestURI drops the scheme and host of absolute-form request lines
+	reqURL := r.URL.RequestURI()[1:]
+
+	//if decoded url has two query params from a decoded escaped fragment for hashbang URLs
+	if strings.Index(reqURL, "?") != strings.LastIndex(reqURL, "?") {
+		reqURL = reqURL[0:strings.LastIndex(reqURL, "?")] + "&" + reqURL[strings.LastIndex(reqURL, "?")+1:]
+	}
+
+	reqURLFinal, err := url.QueryUnescape(reqURL)
+	if err != nil {
+		reqURLFinal = reqURL
+	}
+
+	return parseOptions(tenantDefaults(r, func(name string) string {
+		switch name {
+		case "url":
+			return reqURLFinal
+		case "userAgent":
+			return r.UserAgent()
+		case "format":
+			if f := r.Header.Get("X-Prerender-Format"); f != "" {
+				return f
+			}
+			if strings.HasPrefix(r.Header.Get("Accept"), "application/json") {
+				return formatJSON
+			}
+			return ""
+		case "refresh":
+			// a POST always bypassed the cache
+			if r.Method == "POST" {
+				return "true"
+			}
+		}
+		return r.Header.Get("X-Prerender-" + name)
+	}))
+}
+
+// mapOptions reads options given as a JSON object, as in jobs and batches
+func mapOptions(u string, options map[string]string) (*renderOptions, error) {
+	return parseOptions(func(name string) string {
+		if name == "url" {
+			return u
+		}
+		return options[name]
+	})
+}
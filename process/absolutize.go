@@ -0,0 +1,186 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func init() {
+	Register("absolutize", newAbsolutize)
+}
+
+// absolutize makes the relative URLs of a page absolute, so that they
+// point to the rendered site rather than the prerender host. By default
+// the URLs are rewritten, with the "mode" option set to "base" a
+// <base href> is injected instead
+type absolutize struct {
+	// inject tells whether a base element is injected rather than the
+	// URLs rewritten
+	inject bool
+}
+
+func newAbsolutize(options map[string]string) (Processor, error) {
+	switch mode := options["mode"]; mode {
+	case "", "rewrite":
+		return &absolutize{}, nil
+	case "base":
+		return &absolutize{inject: true}, nil
+	default:
+		return nil, errors.Errorf("mode %q is not rewrite or base", mode)
+	}
+}
+
+func (a *absolutize) Process(ctx context.Context, res *render.Result) error {
+	return ProcessDOM(ctx, a, res)
+}
+
+// urlAttrs are the attributes holding a single URL
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"cite":       true,
+	"data":       true,
+}
+
+func (a *absolutize) ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error {
+	pageURL := res.FinalURL
+	if pageURL == "" {
+		pageURL = res.URL
+	}
+	page, err := url.Parse(pageURL)
+	if err != nil || !page.IsAbs() {
+		return nil
+	}
+
+	// the first base element with a href sets the base of the document,
+	// its own href is relative to the page
+	base := page
+	baseElement := findBase(doc)
+	if baseElement != nil {
+		for i, attr := range baseElement.Attr {
+			if attr.Namespace == "" && attr.Key == "href" {
+				if ref, err := url.Parse(strings.TrimSpace(attr.Val)); err == nil {
+					base = page.ResolveReference(ref)
+					baseElement.Attr[i].Val = base.String()
+				}
+			}
+		}
+	}
+
+	if a.inject {
+		if baseElement == nil {
+			injectBase(doc, page)
+		}
+		return nil
+	}
+
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n == baseElement {
+			return
+		}
+		for i, attr := range n.Attr {
+			if attr.Namespace != "" {
+				continue
+			}
+			switch {
+			case urlAttrs[attr.Key]:
+				n.Attr[i].Val = resolve(base, attr.Val)
+			case attr.Key == "srcset" || attr.Key == "imagesrcset":
+				n.Attr[i].Val = resolveSrcset(base, attr.Val)
+			}
+		}
+	})
+	return nil
+}
+
+func findBase(doc *html.Node) *html.Node {
+	var base *html.Node
+	walk(doc, func(n *html.Node) {
+		if base == nil && n.Type == html.ElementNode && n.DataAtom == atom.Base {
+			for _, attr := range n.Attr {
+				if attr.Namespace == "" && attr.Key == "href" {
+					base = n
+				}
+			}
+		}
+	})
+	return base
+}
+
+// injectBase adds a base element first in the head, before any element
+// using a URL
+func injectBase(doc *html.Node, page *url.URL) {
+	head := find(doc, atom.Head)
+	if head == nil {
+		return
+	}
+	base := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: atom.Base,
+		Data:     "base",
+		Attr:     []html.Attribute{{Key: "href", Val: page.String()}},
+	}
+	head.InsertBefore(base, head.FirstChild)
+}
+
+// resolve makes ref absolute against base. Fragments alone are left as
+// is since they point within the page, and so are the URLs that can't be
+// parsed
+func resolve(base *url.URL, ref string) string {
+	trimmed := strings.TrimSpace(ref)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		return ref
+	}
+	u, err := url.Parse(trimmed)
+	if err != nil || u.IsAbs() {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// resolveSrcset resolves the URLs of the image candidates of a srcset,
+// keeping their descriptors
+func resolveSrcset(base *url.URL, srcset string) string {
+	var b bytes.Buffer
+	s := srcset
+	for {
+		s = strings.TrimLeft(s, " \t\n\r\f,")
+		if s == "" {
+			return b.String()
+		}
+		// a candidate is a URL, which may contain commas but not
+		// whitespace, then optional descriptors up to the next comma
+		end := strings.IndexAny(s, " \t\n\r\f")
+		if end < 0 {
+			end = len(s)
+		}
+		u := s[:end]
+		descriptor := ""
+		s = s[end:]
+		if strings.HasSuffix(u, ",") {
+			u = strings.TrimRight(u, ",")
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			descriptor, s = strings.TrimSpace(s[:comma]), s[comma+1:]
+		} else {
+			descriptor, s = strings.TrimSpace(s), ""
+		}
+
+		if b.Len() > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(resolve(base, u))
+		if descriptor != "" {
+			b.WriteString(" " + descriptor)
+		}
+	}
+}
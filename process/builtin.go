@@ -0,0 +1,155 @@
+package process
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Mixelito/prerender/jsonld"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func init() {
+	Register("statusCode", func(map[string]string) (Processor, error) {
+		return statusCode{}, nil
+	})
+	Register("stripScripts", newStripScripts)
+}
+
+// statusCode applies the prerender-status-code and prerender-header meta
+// tags of the head to the result, and removes them
+type statusCode struct{}
+
+func (p statusCode) Process(ctx context.Context, res *render.Result) error {
+	return ProcessDOM(ctx, p, res)
+}
+
+func (statusCode) ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error {
+	head := find(doc, atom.Head)
+	if head == nil {
+		return nil
+	}
+	var remove []*html.Node
+	walk(head, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.DataAtom != atom.Meta {
+			return
+		}
+		content := strings.TrimSpace(attr(n, "content"))
+		switch strings.ToLower(attr(n, "name")) {
+		case "prerender-status-code":
+			if status, err := strconv.Atoi(content); err == nil && status >= 100 && status <= 599 {
+				res.Status = status
+			}
+			remove = append(remove, n)
+		case "prerender-header":
+			if i := strings.Index(content, ":"); i > 0 {
+				if res.Headers == nil {
+					res.Headers = http.Header{}
+				}
+				res.Headers.Add(strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]))
+			}
+			remove = append(remove, n)
+		}
+	})
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+	return nil
+}
+
+// stripScripts removes script tags according to their type. By default
+// every script is removed except the types listed in the "keep" option,
+// which defaults to JSON-LD. The "drop" option instead lists the only
+// types removed
+type stripScripts struct {
+	types map[string]bool
+	// drop tells whether types are removed rather than kept
+	drop bool
+}
+
+// javascript is the type of scripts without one
+const javascript = "text/javascript"
+
+func newStripScripts(options map[string]string) (Processor, error) {
+	keep, hasKeep := options["keep"]
+	drop, hasDrop := options["drop"]
+	if hasKeep && hasDrop {
+		return nil, errors.New("keep and drop can't be used together")
+	}
+
+	s := &stripScripts{types: map[string]bool{}}
+	list := keep
+	if hasDrop {
+		s.drop = true
+		list = drop
+	}
+	for _, t := range strings.Split(list, ",") {
+		if strings.TrimSpace(t) != "" {
+			s.types[scriptType(t)] = true
+		}
+	}
+	// crawlers read the structured data, it is always kept
+	s.types[jsonld.Type] = !s.drop
+	return s, nil
+}
+
+func (s *stripScripts) Process(ctx context.Context, res *render.Result) error {
+	return ProcessDOM(ctx, s, res)
+}
+
+func (s *stripScripts) ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error {
+	var remove []*html.Node
+	walk(doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Script {
+			if s.types[scriptType(attr(n, "type"))] == s.drop {
+				remove = append(remove, n)
+			}
+		}
+	})
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+	return nil
+}
+
+// scriptType normalizes the type attribute of a script, scripts without
+// one are JavaScript
+func scriptType(t string) string {
+	if t = jsonld.MediaType(t); t == "" {
+		return javascript
+	}
+	return t
+}
+
+// walk calls f on n and its descendants, in document order
+func walk(n *html.Node, f func(*html.Node)) {
+	f(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walk(c, f)
+	}
+}
+
+// find returns the first element of type a in n
+func find(n *html.Node, a atom.Atom) *html.Node {
+	var found *html.Node
+	walk(n, func(c *html.Node) {
+		if found == nil && c.Type == html.ElementNode && c.DataAtom == a {
+			found = c
+		}
+	})
+	return found
+}
+
+// attr returns the value of the attribute key of n
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
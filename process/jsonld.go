@@ -0,0 +1,24 @@
+package process
+
+import (
+	"context"
+
+	"github.com/Mixelito/prerender/jsonld"
+	"github.com/Mixelito/prerender/render"
+)
+
+func init() {
+	Register("validateJsonLd", func(map[string]string) (Processor, error) {
+		return validateJSONLD{}, nil
+	})
+}
+
+// validateJSONLD validates the JSON-LD scripts of the pages into
+// res.StructuredData, so that the broken ones are logged. JSON-LD scripts
+// are kept by stripScripts, the processor can be anywhere in the pipeline
+type validateJSONLD struct{}
+
+func (validateJSONLD) Process(ctx context.Context, res *render.Result) error {
+	res.StructuredData = jsonld.Validate(res.HTML)
+	return nil
+}
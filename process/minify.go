@@ -0,0 +1,281 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func init() {
+	Register("minify", newMinify)
+}
+
+// minify shrinks the HTML: it collapses whitespace, removes comments and
+// minifies inline CSS, each step can be disabled with its option set to
+// false. Stripping the attributes set to their default value is only done
+// with attributes set to true, since input[type=text] and the like no
+// longer match once they are gone
+type minify struct {
+	whitespace bool
+	comments   bool
+	attributes bool
+	css        bool
+	// keepComments are the prefixes of the comments kept on top of the
+	// conditional comments and hydration markers
+	keepComments []string
+}
+
+func newMinify(options map[string]string) (Processor, error) {
+	m := &minify{whitespace: true, comments: true, css: true}
+	for name, dst := range map[string]*bool{
+		"whitespace": &m.whitespace,
+		"comments":   &m.comments,
+		"attributes": &m.attributes,
+		"css":        &m.css,
+	} {
+		if v, ok := options[name]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errors.Errorf("%s must be true or false", name)
+			}
+			*dst = b
+		}
+	}
+	for _, prefix := range strings.Split(options["keepComments"], ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			m.keepComments = append(m.keepComments, prefix)
+		}
+	}
+	return m, nil
+}
+
+func (m *minify) Process(ctx context.Context, res *render.Result) error {
+	return ProcessDOM(ctx, m, res)
+}
+
+func (m *minify) ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error {
+	var remove []*html.Node
+	walk(doc, func(n *html.Node) {
+		switch n.Type {
+		case html.CommentNode:
+			if m.comments && !m.keepComment(n.Data) {
+				remove = append(remove, n)
+			}
+		case html.TextNode:
+			if !m.whitespace || preformatted(n) {
+				return
+			}
+			if strings.TrimSpace(n.Data) == "" && n.Parent != nil && (n.Parent.DataAtom == atom.Html || n.Parent.DataAtom == atom.Head) {
+				// nothing is displayed out of the body
+				remove = append(remove, n)
+				return
+			}
+			n.Data = collapseSpace(n.Data)
+		case html.ElementNode:
+			if m.attributes {
+				n.Attr = stripDefaultAttrs(n)
+			}
+			if m.css {
+				for i, a := range n.Attr {
+					if a.Namespace == "" && a.Key == "style" {
+						n.Attr[i].Val = minifyCSS(a.Val, true)
+					}
+				}
+				if n.DataAtom == atom.Style {
+					for c := n.FirstChild; c != nil; c = c.NextSibling {
+						if c.Type == html.TextNode {
+							c.Data = minifyCSS(c.Data, false)
+						}
+					}
+				}
+			}
+		}
+	})
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+	return nil
+}
+
+// hydrationMarkers are the comments frameworks render on the server and
+// look for when hydrating the page: React, Vue and Svelte
+var hydrationMarkers = map[string]bool{
+	"":   true,
+	"$":  true,
+	"/$": true,
+	"$?": true,
+	"$!": true,
+	"[":  true,
+	"]":  true,
+	"[!": true,
+	"-":  true,
+}
+
+// keepComment tells whether a comment may change the page: conditional
+// comments, hydration markers and the configured prefixes
+func (m *minify) keepComment(data string) bool {
+	trimmed := strings.TrimSpace(data)
+	if hydrationMarkers[trimmed] || strings.HasPrefix(trimmed, "[if ") || strings.HasPrefix(trimmed, "<![endif]") {
+		return true
+	}
+	for _, prefix := range m.keepComments {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// preformatted tells whether the whitespace of a text node is displayed
+// as is, or is code
+func preformatted(n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		switch p.DataAtom {
+		case atom.Pre, atom.Textarea, atom.Script, atom.Style, atom.Plaintext, atom.Xmp:
+			return true
+		}
+	}
+	return false
+}
+
+var spaces = regexp.MustCompile(`[ \t\n\f\r]+`)
+
+func collapseSpace(s string) string {
+	return spaces.ReplaceAllString(s, " ")
+}
+
+// defaultAttrs are the attributes whose value is the one browsers assume
+// when they are missing, by element
+var defaultAttrs = map[atom.Atom]map[string]string{
+	atom.Script: {"type": "text/javascript", "language": "javascript"},
+	atom.Style:  {"type": "text/css", "media": "all"},
+	atom.Link:   {"type": "text/css", "media": "all"},
+	atom.Form:   {"method": "get"},
+	atom.Input:  {"type": "text"},
+}
+
+func stripDefaultAttrs(n *html.Node) []html.Attribute {
+	defaults, ok := defaultAttrs[n.DataAtom]
+	if !ok {
+		return n.Attr
+	}
+	attrs := n.Attr[:0]
+	for _, a := range n.Attr {
+		if def, ok := defaults[a.Key]; ok && a.Namespace == "" && strings.EqualFold(strings.TrimSpace(a.Val), def) {
+			continue
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// minifyCSS removes the comments and the whitespace that isn't needed
+// from a style sheet, leaving strings untouched. declarations tells
+// whether css is a list of declarations, like a style attribute
+func minifyCSS(css string, declarations bool) string {
+	w := cssWriter{statement: true}
+	if declarations {
+		w.blocks = []bool{false}
+	}
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(css) && css[end] != c {
+				if css[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(css) {
+				end = len(css) - 1
+			}
+			w.write(css[i : end+1])
+			i = end
+		case c == '/' && i+1 < len(css) && css[i+1] == '*':
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				return w.buf.String()
+			}
+			i += end + 3
+			w.space = true
+		case isSpace(c):
+			w.space = true
+		case c == ';' && (nextNonSpace(css, i+1) == '}' || nextNonSpace(css, i+1) == 0):
+			// the last declaration of a block needs no semicolon
+		default:
+			w.write(css[i : i+1])
+		}
+	}
+	return w.buf.String()
+}
+
+// cssWriter writes the tokens of a style sheet, with a space between
+// them only where it's significant
+type cssWriter struct {
+	buf bytes.Buffer
+	// space is set when whitespace was skipped before the next token
+	space bool
+	// blocks tells for each open block whether it belongs to an at-rule,
+	// like @media, and so contains rules rather than declarations
+	blocks []bool
+	// statement is set at the start of a rule or a declaration, atRule
+	// once it's known to start with @
+	statement, atRule bool
+}
+
+// cssSeparators need no space around them. A space before a colon is
+// only dropped in declarations since "a :hover" isn't "a:hover", and
+// parentheses and operators are left alone, "and (" and "1px + 2px" need
+// theirs
+const cssSeparators = "{};,>~"
+
+func (w *cssWriter) write(s string) {
+	c := s[0]
+	if w.space && w.buf.Len() > 0 {
+		prev := w.buf.Bytes()[w.buf.Len()-1]
+		inDeclarations := len(w.blocks) > 0 && !w.blocks[len(w.blocks)-1]
+		if !strings.ContainsRune(cssSeparators+":", rune(prev)) && !strings.ContainsRune(cssSeparators, rune(c)) && !(c == ':' && inDeclarations) {
+			w.buf.WriteByte(' ')
+		}
+	}
+	w.space = false
+	if w.statement {
+		w.atRule = c == '@'
+		w.statement = false
+	}
+	switch c {
+	case '{':
+		w.blocks = append(w.blocks, w.atRule)
+		w.statement = true
+	case '}':
+		if len(w.blocks) > 0 {
+			w.blocks = w.blocks[:len(w.blocks)-1]
+		}
+		w.statement = true
+	case ';':
+		w.statement = true
+	}
+	w.buf.WriteString(s)
+}
+
+func nextNonSpace(s string, i int) byte {
+	for ; i < len(s) && isSpace(s[i]); i++ {
+	}
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
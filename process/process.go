@@ -0,0 +1,185 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// Processor transforms a rendered page before it is cached and served.
+// It may change the HTML, the status and the headers of the result
+type Processor interface {
+	Process(ctx context.Context, res *render.Result) error
+}
+
+// ProcessorFunc adapts a function to the Processor interface
+type ProcessorFunc func(ctx context.Context, res *render.Result) error
+
+func (f ProcessorFunc) Process(ctx context.Context, res *render.Result) error {
+	return f(ctx, res)
+}
+
+// DOMProcessor is implemented by processors working on the parsed
+// document. Consecutive DOM processors of a pipeline share a single parse
+// of the HTML, which is serialized again once they ran
+type DOMProcessor interface {
+	Processor
+	ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error
+}
+
+// ProcessDOM runs a DOM processor alone, parsing and serializing the HTML
+// of res. It implements Process for DOM processors
+func ProcessDOM(ctx context.Context, p DOMProcessor, res *render.Result) error {
+	doc, err := html.Parse(strings.NewReader(res.HTML))
+	if err != nil {
+		return errors.Wrap(err, "parsing html failed")
+	}
+	if err = p.ProcessDOM(ctx, doc, res); err != nil {
+		return err
+	}
+	return serialize(doc, res)
+}
+
+func serialize(doc *html.Node, res *render.Result) error {
+	var buf bytes.Buffer
+	if err := html.Render(&buf, doc); err != nil {
+		return errors.Wrap(err, "serializing html failed")
+	}
+	res.HTML = buf.String()
+	return nil
+}
+
+// Factory creates a processor from the options of its configuration
+type Factory func(options map[string]string) (Processor, error)
+
+var (
+	mu        sync.RWMutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a processor available to the configuration under name.
+// It panics if the name is already taken
+func Register(name string, f Factory) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := factories[name]; dup {
+		panic("process: Register called twice for processor " + name)
+	}
+	factories[name] = f
+}
+
+// Names returns the names of the registered processors
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Pipeline runs processors in order on the pages of the hosts they are
+// enabled for
+type Pipeline struct {
+	steps []step
+}
+
+type step struct {
+	name      string
+	hosts     []string
+	processor Processor
+}
+
+// NewPipeline creates the processors configured in steps, in order
+func NewPipeline(steps []config.Processor) (*Pipeline, error) {
+	p := &Pipeline{}
+	for _, s := range steps {
+		mu.RLock()
+		factory, ok := factories[s.Name]
+		mu.RUnlock()
+		if !ok {
+			return nil, errors.Errorf("unknown processor %q, available: %s", s.Name, strings.Join(Names(), ", "))
+		}
+		for _, host := range s.Hosts {
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid host %s for processor %s", host, s.Name)
+			}
+		}
+		processor, err := factory(s.Options)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid options for processor %s", s.Name)
+		}
+		p.steps = append(p.steps, step{name: s.Name, hosts: s.Hosts, processor: processor})
+	}
+	return p, nil
+}
+
+// Process runs the processors enabled for the host of the page. A nil
+// pipeline does nothing
+func (p *Pipeline) Process(ctx context.Context, res *render.Result) error {
+	if p == nil {
+		return nil
+	}
+	var host string
+	if u, err := url.Parse(res.URL); err == nil {
+		host = strings.ToLower(u.Hostname())
+	}
+	// the document parsed for the DOM processors, until another
+	// processor needs the HTML
+	var doc *html.Node
+	for _, s := range p.steps {
+		if !s.enabledFor(host) {
+			continue
+		}
+		dp, isDOM := s.processor.(DOMProcessor)
+		if !isDOM {
+			if doc != nil {
+				if err := serialize(doc, res); err != nil {
+					return err
+				}
+				doc = nil
+			}
+			if err := s.processor.Process(ctx, res); err != nil {
+				return errors.Wrap(err, "processor "+s.name+" failed")
+			}
+			continue
+		}
+
+		if doc == nil {
+			var err error
+			if doc, err = html.Parse(strings.NewReader(res.HTML)); err != nil {
+				return errors.Wrap(err, "parsing html failed")
+			}
+		}
+		if err := dp.ProcessDOM(ctx, doc, res); err != nil {
+			return errors.Wrap(err, "processor "+s.name+" failed")
+		}
+	}
+	if doc != nil {
+		return serialize(doc, res)
+	}
+	return nil
+}
+
+func (s step) enabledFor(host string) bool {
+	if len(s.hosts) == 0 {
+		return true
+	}
+	for _, pattern := range s.hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/render"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/html"
+)
+
+func init() {
+	Register("append", func(options map[string]string) (Processor, error) {
+		if options["text"] == "" {
+			return nil, errors.New("text is required")
+		}
+		return ProcessorFunc(func(ctx context.Context, res *render.Result) error {
+			res.HTML += options["text"]
+			return nil
+		}), nil
+	})
+	Register("fail", func(map[string]string) (Processor, error) {
+		return ProcessorFunc(func(ctx context.Context, res *render.Result) error {
+			return errors.New("boom")
+		}), nil
+	})
+}
+
+func TestPipelineOrder(t *testing.T) {
+	p, err := NewPipeline([]config.Processor{
+		{Name: "append", Options: map[string]string{"text": "a"}},
+		{Name: "append", Options: map[string]string{"text": "b"}, Hosts: []string{"*.example.com"}},
+		{Name: "append", Options: map[string]string{"text": "c"}, Hosts: []string{"example.org"}},
+	})
+	require.NoError(t, err)
+
+	res := &render.Result{URL: "https://www.Example.com/page"}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, "ab", res.HTML)
+
+	res = &render.Result{URL: "https://example.org/"}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, "ac", res.HTML)
+}
+
+func TestPipelineErrors(t *testing.T) {
+	_, err := NewPipeline([]config.Processor{{Name: "nope"}})
+	assert.EqualError(t, err, `unknown processor "nope", available: absolutize, append, fail, minify, softErrors, statusCode, stripScripts, validateJsonLd`)
+
+	_, err = NewPipeline([]config.Processor{{Name: "append"}})
+	assert.EqualError(t, err, "invalid options for processor append: text is required")
+
+	_, err = NewPipeline([]config.Processor{{Name: "append", Hosts: []string{"[example.com"}}})
+	assert.Error(t, err)
+
+	p, err := NewPipeline([]config.Processor{{Name: "fail"}})
+	require.NoError(t, err)
+	assert.EqualError(t, p.Process(context.Background(), &render.Result{}), "processor fail failed: boom")
+
+	var nilPipeline *Pipeline
+	assert.NoError(t, nilPipeline.Process(context.Background(), &render.Result{}))
+}
+
+func TestRegisterTwice(t *testing.T) {
+	assert.Panics(t, func() {
+		Register("statusCode", nil)
+	})
+}
+
+func TestStatusCode(t *testing.T) {
+	res := &render.Result{
+		Status: http.StatusOK,
+		HTML: `<!DOCTYPE html><html><head>
+<meta content="404"
+      name="Prerender-Status-Code">
+<script>var s = "</head>";</script>
+<meta name="prerender-header" content="X-Robots-Tag: noindex">
+</head><body><meta name="prerender-status-code" content="500"></body></html>`,
+	}
+	require.NoError(t, ProcessDOM(context.Background(), statusCode{}, res))
+	assert.Equal(t, http.StatusNotFound, res.Status)
+	assert.Equal(t, "noindex", res.Headers.Get("X-Robots-Tag"))
+	// only the head is looked at
+	assert.Equal(t, `<!DOCTYPE html><html><head>
+
+<script>var s = "</head>";</script>
+
+</head><body><meta name="prerender-status-code" content="500"/></body></html>`, res.HTML)
+}
+
+func TestStripScripts(t *testing.T) {
+	html := `<html><head><script src="app.js"></script><SCRIPT type="text/template">
+<p>{{ name }}</p>
+</SCRIPT><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`
+
+	for _, test := range []struct {
+		options  map[string]string
+		expected string
+	}{
+		{nil, `<html><head><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		{map[string]string{"keep": "text/template, application/ld+json"}, `<html><head><script type="text/template">
+<p>{{ name }}</p>
+</script><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		{map[string]string{"keep": ""}, `<html><head><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		// JSON-LD is kept without being listed, and can't be dropped
+		{map[string]string{"keep": "text/x-template"}, `<html><head><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		{map[string]string{"keep": "text/template"}, `<html><head><script type="text/template">
+<p>{{ name }}</p>
+</script><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		{map[string]string{"drop": "text/javascript, application/ld+json"}, `<html><head><script type="text/template">
+<p>{{ name }}</p>
+</script><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+		{map[string]string{"drop": "text/javascript"}, `<html><head><script type="text/template">
+<p>{{ name }}</p>
+</script><script type="application/ld+json; charset=utf-8">{}</script></head><body></body></html>`},
+	} {
+		p, err := newStripScripts(test.options)
+		require.NoError(t, err)
+		res := &render.Result{HTML: html}
+		require.NoError(t, p.Process(context.Background(), res))
+		assert.Equal(t, test.expected, res.HTML, "%v", test.options)
+	}
+
+	_, err := newStripScripts(map[string]string{"keep": "a", "drop": "b"})
+	assert.Error(t, err)
+}
+
+func TestPipelineSharesParse(t *testing.T) {
+	p, err := NewPipeline([]config.Processor{
+		{Name: "statusCode"},
+		{Name: "append", Options: map[string]string{"text": "<!-- appended -->"}},
+		{Name: "stripScripts"},
+	})
+	require.NoError(t, err)
+	res := &render.Result{HTML: `<html><head><meta name="prerender-status-code" content="410"><script></script></head></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, http.StatusGone, res.Status)
+	// the html is serialized for append, then parsed again for stripScripts
+	assert.Equal(t, `<html><head></head><body></body></html><!-- appended -->`, res.HTML)
+}
+
+func TestMinify(t *testing.T) {
+	p, err := newMinify(nil)
+	require.NoError(t, err)
+	res := &render.Result{HTML: `<!DOCTYPE html>
+<html>
+  <head>
+    <!-- build 1234 -->
+    <!--[if IE]><link rel="stylesheet" href="ie.css"><![endif]-->
+    <style type="text/css">
+      /* layout */
+      body  >  p { margin : 0 auto ; content: "a  b" ; }
+    </style>
+    <script type="text/javascript">var  a = 1;</script>
+  </head>
+  <body>
+    <p style="color : red ;">Hello,
+      <b>world</b>  !</p>
+    <div id="root"><!--$-->ready<!--/$--><!--[--><!--]--></div>
+    <pre>  keep
+  this  </pre>
+    <form method="GET"><input type="text" name="q"></form>
+  </body>
+</html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<!DOCTYPE html><html><head><!--[if IE]><link rel="stylesheet" href="ie.css"><![endif]--><style type="text/css">body>p{margin:0 auto;content:"a  b"}</style><script type="text/javascript">var  a = 1;</script></head><body> <p style="color:red">Hello, <b>world</b> !</p> <div id="root"><!--$-->ready<!--/$--><!--[--><!--]--></div> <pre>  keep
+  this  </pre> <form method="GET"><input type="text" name="q"/></form> </body></html>`, res.HTML)
+}
+
+func TestMinifyAttributes(t *testing.T) {
+	p, err := newMinify(map[string]string{"attributes": "true"})
+	require.NoError(t, err)
+	res := &render.Result{HTML: `<html><head><style type="text/css"></style><script type=" Text/JavaScript " src="app.js"></script><script type="module"></script></head>` +
+		`<body><form method="GET"><input type="text" name="q"><input type="email"></form></body></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<html><head><style></style><script src="app.js"></script><script type="module"></script></head>`+
+		`<body><form><input name="q"/><input type="email"/></form></body></html>`, res.HTML)
+}
+
+func TestMinifyOptions(t *testing.T) {
+	p, err := newMinify(map[string]string{"whitespace": "false", "css": "false", "keepComments": "ko , esi"})
+	require.NoError(t, err)
+	res := &render.Result{HTML: `<html><head><style> p { } </style></head><body><!-- ko if: a -->  <!-- esi:include --> <!-- other --></body></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<html><head><style> p { } </style></head><body><!-- ko if: a -->  <!-- esi:include --> </body></html>`, res.HTML)
+
+	_, err = newMinify(map[string]string{"css": "sometimes"})
+	assert.Error(t, err)
+}
+
+func TestMinifyCSS(t *testing.T) {
+	for _, test := range []struct {
+		css, expected string
+		declarations  bool
+	}{
+		{"a { color : red; }", "a{color:red}", false},
+		{"a:hover , b ~ i { margin: 0 1px }", "a:hover,b~i{margin:0 1px}", false},
+		{"div :hover { top: 0 }", "div :hover{top:0}", false},
+		{"@media screen and (max-width: 600px) { a :first-child { top: 0; } }", "@media screen and (max-width:600px){a :first-child{top:0}}", false},
+		{"a { width: calc(100% - 2px) }", "a{width:calc(100% - 2px)}", false},
+		{`a::after { content: "} ;" }`, `a::after{content:"} ;"}`, false},
+		{"a { top: 0 } /* unterminated", "a{top:0}", false},
+		{"color : red ; margin: 0 ;", "color:red;margin:0", true},
+	} {
+		assert.Equal(t, test.expected, minifyCSS(test.css, test.declarations), test.css)
+	}
+}
+
+func TestAbsolutize(t *testing.T) {
+	page := `<html><head><link rel="stylesheet" href="/app.css"></head><body>` +
+		`<a href="about">About</a><a href="#top">Top</a><a href="mailto:a@example.com">Mail</a>` +
+		`<img src="//cdn.example.com/a.png" srcset="a-1x.png 1x, /a,2x.png 2x,b.png"><form action="?q=1"></form></body></html>`
+
+	p, err := newAbsolutize(nil)
+	require.NoError(t, err)
+	// URLs are relative to the final URL, after redirects
+	res := &render.Result{URL: "http://example.com/", FinalURL: "https://www.example.com/docs/index.html", HTML: page}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<html><head><link rel="stylesheet" href="https://www.example.com/app.css"/></head><body>`+
+		`<a href="https://www.example.com/docs/about">About</a><a href="#top">Top</a><a href="mailto:a@example.com">Mail</a>`+
+		`<img src="https://cdn.example.com/a.png" srcset="https://www.example.com/docs/a-1x.png 1x, https://www.example.com/a,2x.png 2x, https://www.example.com/docs/b.png"/>`+
+		`<form action="https://www.example.com/docs/index.html?q=1"></form></body></html>`, res.HTML)
+
+	// an existing base is honored
+	res = &render.Result{URL: "https://example.com/a/b", HTML: `<html><head><base href="/static/"></head><body><img src="x.png"></body></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<html><head><base href="https://example.com/static/"/></head><body><img src="https://example.com/static/x.png"/></body></html>`, res.HTML)
+}
+
+func TestAbsolutizeBase(t *testing.T) {
+	p, err := newAbsolutize(map[string]string{"mode": "base"})
+	require.NoError(t, err)
+	res := &render.Result{URL: "https://example.com/a/b", HTML: `<html><head><script src="app.js"></script></head><body><img src="x.png"></body></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, `<html><head><base href="https://example.com/a/b"/><script src="app.js"></script></head><body><img src="x.png"/></body></html>`, res.HTML)
+
+	_, err = newAbsolutize(map[string]string{"mode": "relative"})
+	assert.Error(t, err)
+}
+
+func TestSelector(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<html><body><div id="app" class="main dark"><ul><li><a href="/x" data-id="a-1">X</a></li></ul></div><p lang="en-US"></p></body></html>`))
+	require.NoError(t, err)
+	for source, found := range map[string]bool{
+		"a":                       true,
+		"#app":                    true,
+		"div.main.dark":           true,
+		"div.main.light":          false,
+		"#app a":                  true,
+		"#app > a":                false,
+		"#app > ul > li > a":      true,
+		"body > *":                true,
+		"[data-id]":               true,
+		`a[data-id="a-1"]`:        true,
+		"a[data-id^=a-]":          true,
+		"a[data-id$=2]":           false,
+		"a[href*=x]":              true,
+		"[class~=dark]":           true,
+		"p[lang|=en]":             true,
+		"section, p":              true,
+		"section, #app > section": false,
+	} {
+		sel, err := ParseSelector(source)
+		require.NoError(t, err, source)
+		assert.Equal(t, found, sel.First(doc) != nil, source)
+	}
+	for _, source := range []string{"", "a,", "> a", "a >", "a:hover", "a[href", "#"} {
+		_, err := ParseSelector(source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestSoftErrors(t *testing.T) {
+	p, err := newSoftErrors(map[string]string{
+		"minTextLength": "20",
+		"required":      "#app > *",
+		"notFound":      ".not-found",
+		"notFoundTitle": "(?i)not found",
+		"failedStatus":  "502",
+	})
+	require.NoError(t, err)
+	for _, test := range []struct {
+		html    string
+		status  int
+		failure string
+	}{
+		{`<title>Home</title><div id="app"><h1>Welcome to the example home page</h1></div>`, 200, ""},
+		{`<title>Page not found</title><div id="app"><h1>Sorry, this page doesn't exist</h1></div>`, 404, `not found: title "Page not found" matches (?i)not found`},
+		{`<title>Home</title><div id="app"><div class="not-found">Sorry, this page doesn't exist</div></div>`, 404, "not found: an element matches .not-found"},
+		{`<title>Home</title><div id="app"></div><script>var app = "a long script which isn't text"</script>`, 502, "failed: no element matches #app > *"},
+		{`<title>Home</title><div id="app"><p>Loading…</p></div>`, 502, "failed: 8 characters of text, less than 20"},
+	} {
+		res := &render.Result{URL: "https://example.com/", Status: http.StatusOK, HTML: test.html}
+		require.NoError(t, p.Process(context.Background(), res))
+		assert.Equal(t, test.status, res.Status, test.html)
+		assert.Equal(t, test.failure, res.Failure, test.html)
+	}
+
+	// a status set by the page wins
+	res := &render.Result{URL: "https://example.com/", Status: http.StatusGone, HTML: `<div class="not-found"></div>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	assert.Equal(t, http.StatusGone, res.Status)
+	assert.Empty(t, res.Failure)
+
+	for _, options := range []map[string]string{
+		nil,
+		{"minTextLength": "-1"},
+		{"required": "a:hover"},
+		{"notFoundTitle": "("},
+		{"notFound": ".x", "notFoundStatus": "999"},
+	} {
+		_, err := newSoftErrors(options)
+		assert.Error(t, err, "%v", options)
+	}
+}
+
+func TestValidateJSONLD(t *testing.T) {
+	p, err := NewPipeline([]config.Processor{{Name: "stripScripts"}, {Name: "validateJsonLd"}})
+	require.NoError(t, err)
+	res := &render.Result{URL: "https://example.com/", Status: http.StatusOK, HTML: `<html><head>
+<script>app()</script><script type="application/ld+json">{"@context": "https://schema.org", "@type": "Organization", "name": "Example"}</script>
+</head></html>`}
+	require.NoError(t, p.Process(context.Background(), res))
+	require.NotNil(t, res.StructuredData)
+	assert.False(t, res.StructuredData.Valid)
+	require.Len(t, res.StructuredData.Blocks, 1)
+	assert.Equal(t, []string{`Organization: missing "url"`}, res.StructuredData.Blocks[0].Errors)
+}
@@ -0,0 +1,261 @@
+package process
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+)
+
+// Selector is a list of CSS selectors, separated by commas in its source.
+// It supports the common subset of CSS: type, #id, .class and attribute
+// selectors, joined by descendant and child combinators
+type Selector struct {
+	source    string
+	selectors []complexSelector
+}
+
+// complexSelector is a chain of compound selectors, the last one matching
+// the element itself
+type complexSelector []compoundSelector
+
+type compoundSelector struct {
+	// child tells whether the combinator before the compound is ">"
+	child   bool
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrSelector
+}
+
+type attrSelector struct {
+	key string
+	// op is "" when the attribute only has to be present
+	op, val string
+}
+
+// ParseSelector parses a comma-separated list of CSS selectors
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{source: strings.TrimSpace(s)}
+	for _, source := range strings.Split(s, ",") {
+		c, err := parseComplexSelector(strings.TrimSpace(source))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid selector %q", s)
+		}
+		sel.selectors = append(sel.selectors, c)
+	}
+	return sel, nil
+}
+
+func (s *Selector) String() string {
+	return s.source
+}
+
+func parseComplexSelector(s string) (complexSelector, error) {
+	if s == "" {
+		return nil, errors.New("empty selector")
+	}
+	var c complexSelector
+	child := false
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case ' ', '\t', '\n':
+			i++
+			continue
+		case '>':
+			if child || len(c) == 0 {
+				return nil, errors.New("unexpected >")
+			}
+			child = true
+			i++
+			continue
+		}
+		compound, n, err := parseCompoundSelector(s[i:])
+		if err != nil {
+			return nil, err
+		}
+		compound.child = child
+		c = append(c, compound)
+		child = false
+		i += n
+	}
+	if child {
+		return nil, errors.New("unexpected >")
+	}
+	return c, nil
+}
+
+// parseCompoundSelector parses the compound selector starting s, and
+// returns the number of bytes it took
+func parseCompoundSelector(s string) (compoundSelector, int, error) {
+	var c compoundSelector
+	i := identEnd(s, 0)
+	if i == 0 && strings.HasPrefix(s, "*") {
+		i = 1
+	}
+	c.tag = strings.ToLower(s[:i])
+	for i < len(s) {
+		switch s[i] {
+		case '#', '.':
+			end := identEnd(s, i+1)
+			if end == i+1 {
+				return c, 0, errors.Errorf("expected a name after %c", s[i])
+			}
+			if s[i] == '#' {
+				c.id = s[i+1 : end]
+			} else {
+				c.classes = append(c.classes, s[i+1:end])
+			}
+			i = end
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return c, 0, errors.New("unclosed [")
+			}
+			a, err := parseAttrSelector(s[i+1 : i+end])
+			if err != nil {
+				return c, 0, err
+			}
+			c.attrs = append(c.attrs, a)
+			i += end + 1
+		case ' ', '\t', '\n', '>':
+			return c, i, nil
+		default:
+			return c, 0, errors.Errorf("unsupported %q", s[i:])
+		}
+	}
+	if i == 0 {
+		return c, 0, errors.New("empty selector")
+	}
+	return c, i, nil
+}
+
+func parseAttrSelector(s string) (attrSelector, error) {
+	var a attrSelector
+	end := identEnd(s, 0)
+	if end == 0 {
+		return a, errors.New("expected an attribute name")
+	}
+	a.key = strings.ToLower(s[:end])
+	rest := strings.TrimSpace(s[end:])
+	if rest == "" {
+		return a, nil
+	}
+	for _, op := range []string{"=", "~=", "|=", "^=", "$=", "*="} {
+		if strings.HasPrefix(rest, op) {
+			a.op = op
+			a.val = strings.Trim(strings.TrimSpace(rest[len(op):]), `"'`)
+			return a, nil
+		}
+	}
+	return a, errors.Errorf("unsupported attribute selector %q", s)
+}
+
+func identEnd(s string, i int) int {
+	for ; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= 0x80) {
+			break
+		}
+	}
+	return i
+}
+
+// Match reports whether the element n matches one of the selectors
+func (s *Selector) Match(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	for _, c := range s.selectors {
+		if c.matchAt(len(c)-1, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// First returns the first element of doc matching the selector
+func (s *Selector) First(doc *html.Node) *html.Node {
+	var found *html.Node
+	walk(doc, func(n *html.Node) {
+		if found == nil && s.Match(n) {
+			found = n
+		}
+	})
+	return found
+}
+
+func (c complexSelector) matchAt(i int, n *html.Node) bool {
+	if !c[i].matches(n) {
+		return false
+	}
+	if i == 0 {
+		return true
+	}
+	for p := n.Parent; p != nil && p.Type == html.ElementNode; p = p.Parent {
+		if c.matchAt(i-1, p) {
+			return true
+		}
+		if c[i].child {
+			break
+		}
+	}
+	return false
+}
+
+func (c compoundSelector) matches(n *html.Node) bool {
+	if c.tag != "" && c.tag != "*" && c.tag != n.Data {
+		return false
+	}
+	if c.id != "" && attr(n, "id") != c.id {
+		return false
+	}
+	if len(c.classes) > 0 {
+		classes := strings.Fields(attr(n, "class"))
+		for _, class := range c.classes {
+			if !contains(classes, class) {
+				return false
+			}
+		}
+	}
+	for _, a := range c.attrs {
+		if !a.matches(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a attrSelector) matches(n *html.Node) bool {
+	for _, at := range n.Attr {
+		if at.Namespace != "" || at.Key != a.key {
+			continue
+		}
+		switch a.op {
+		case "":
+			return true
+		case "=":
+			return at.Val == a.val
+		case "~=":
+			return contains(strings.Fields(at.Val), a.val)
+		case "|=":
+			return at.Val == a.val || strings.HasPrefix(at.Val, a.val+"-")
+		case "^=":
+			return a.val != "" && strings.HasPrefix(at.Val, a.val)
+		case "$=":
+			return a.val != "" && strings.HasSuffix(at.Val, a.val)
+		case "*=":
+			return a.val != "" && strings.Contains(at.Val, a.val)
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
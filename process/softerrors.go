@@ -0,0 +1,154 @@
+package process
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Mixelito/prerender/render"
+	"github.com/pkg/errors"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+func init() {
+	Register("softErrors", newSoftErrors)
+}
+
+// softErrors detects the pages which respond 200 but are broken: a "not
+// found" view of a single page application, or a page left empty by a
+// JavaScript error. Not found pages get the "notFoundStatus" status, 404
+// by default, and failed ones "failedStatus", 503 by default. Either way
+// res.Failure is set, so the page isn't cached
+type softErrors struct {
+	// minTextLength fails the pages whose body has less text
+	minTextLength int
+	// required fails the pages where no element matches
+	required *Selector
+	// notFound and notFoundTitle detect the not found pages, by an
+	// element and by their title
+	notFound      *Selector
+	notFoundTitle *regexp.Regexp
+
+	failedStatus   int
+	notFoundStatus int
+}
+
+func newSoftErrors(options map[string]string) (Processor, error) {
+	s := &softErrors{failedStatus: http.StatusServiceUnavailable, notFoundStatus: http.StatusNotFound}
+	var err error
+	if v := options["minTextLength"]; v != "" {
+		if s.minTextLength, err = strconv.Atoi(v); err != nil || s.minTextLength < 0 {
+			return nil, errors.Errorf("minTextLength must be a positive number")
+		}
+	}
+	for name, dst := range map[string]**Selector{
+		"required": &s.required,
+		"notFound": &s.notFound,
+	} {
+		if v := options[name]; v != "" {
+			if *dst, err = ParseSelector(v); err != nil {
+				return nil, errors.Wrap(err, name)
+			}
+		}
+	}
+	if v := options["notFoundTitle"]; v != "" {
+		if s.notFoundTitle, err = regexp.Compile(v); err != nil {
+			return nil, errors.Wrap(err, "notFoundTitle")
+		}
+	}
+	for name, dst := range map[string]*int{
+		"failedStatus":   &s.failedStatus,
+		"notFoundStatus": &s.notFoundStatus,
+	} {
+		if v := options[name]; v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil || *dst < 100 || *dst > 599 {
+				return nil, errors.Errorf("%s must be an HTTP status", name)
+			}
+		}
+	}
+	if s.minTextLength == 0 && s.required == nil && s.notFound == nil && s.notFoundTitle == nil {
+		return nil, errors.New("set at least one of minTextLength, required, notFound and notFoundTitle")
+	}
+	return s, nil
+}
+
+func (s *softErrors) Process(ctx context.Context, res *render.Result) error {
+	return ProcessDOM(ctx, s, res)
+}
+
+func (s *softErrors) ProcessDOM(ctx context.Context, doc *html.Node, res *render.Result) error {
+	// the page already has a status of its own, e.g. from its
+	// prerender-status-code meta tag
+	if res.Status != http.StatusOK {
+		return nil
+	}
+	if status, failure := s.detect(doc); failure != "" {
+		res.Status = status
+		res.Failure = failure
+	}
+	return nil
+}
+
+// detect returns the status and the reason of a broken page, and no
+// reason for a page which looks fine
+func (s *softErrors) detect(doc *html.Node) (int, string) {
+	if s.notFoundTitle != nil {
+		if title := find(doc, atom.Title); title != nil {
+			if text := collapse(textContent(title)); s.notFoundTitle.MatchString(text) {
+				return s.notFoundStatus, fmt.Sprintf("not found: title %q matches %s", text, s.notFoundTitle)
+			}
+		}
+	}
+	if s.notFound != nil && s.notFound.First(doc) != nil {
+		return s.notFoundStatus, "not found: an element matches " + s.notFound.String()
+	}
+	if s.required != nil && s.required.First(doc) == nil {
+		return s.failedStatus, "failed: no element matches " + s.required.String()
+	}
+	if s.minTextLength > 0 {
+		var length int
+		if body := find(doc, atom.Body); body != nil {
+			length = utf8.RuneCountInString(collapse(textContent(body)))
+		}
+		if length < s.minTextLength {
+			return s.failedStatus, fmt.Sprintf("failed: %d characters of text, less than %d", length, s.minTextLength)
+		}
+	}
+	return 0, ""
+}
+
+// textContent returns the text of n, without the scripts, styles and
+// templates which don't render
+func textContent(n *html.Node) string {
+	var buf bytes.Buffer
+	var text func(*html.Node)
+	text = func(n *html.Node) {
+		switch n.Type {
+		case html.TextNode:
+			buf.WriteString(n.Data)
+			buf.WriteByte(' ')
+			return
+		case html.ElementNode:
+			switch n.DataAtom {
+			case atom.Script, atom.Style, atom.Noscript, atom.Template:
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			text(c)
+		}
+	}
+	text(n)
+	return buf.String()
+}
+
+// collapse trims s and collapses its runs of whitespace to single spaces
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
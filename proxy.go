@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/middleware"
+	"github.com/Mixelito/prerender/render"
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// proxy puts the service in front of the origin of a site: crawlers get
+// rendered pages, every other request is proxied unchanged
+type proxy struct {
+	upstream *httputil.ReverseProxy
+	// crawlers detects the requests to render, and the URL of their page
+	crawlers *middleware.Prerender
+	// hosts are the hosts rendered, the URLs of the others are proxied so
+	// the service can't be used to render any site
+	hosts []string
+}
+
+func newProxy(c config.Proxy) (*proxy, error) {
+	upstream, err := url.Parse(c.Upstream)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid upstream")
+	}
+	rp := httputil.NewSingleHostReverseProxy(upstream)
+	director := rp.Director
+	rp.Director = func(r *http.Request) {
+		if r.Header.Get("X-Forwarded-Host") == "" {
+			r.Header.Set("X-Forwarded-Host", r.Host)
+		}
+		if r.Header.Get("X-Forwarded-Proto") == "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			r.Header.Set("X-Forwarded-Proto", scheme)
+		}
+		director(r)
+	}
+	return &proxy{
+		upstream: rp,
+		hosts:    append([]string{upstream.Hostname()}, c.Hosts...),
+		crawlers: middleware.New(middleware.Options{
+			CrawlerUserAgents: c.CrawlerUserAgents,
+			Scheme:            c.Scheme,
+		}),
+	}, nil
+}
+
+// serveProxy serves the requests in proxy mode. Only the probes of the
+// service are served next to the site, not its API
+func (a *app) serveProxy(w http.ResponseWriter, r *http.Request) *render.Result {
+	switch r.URL.Path {
+	case "/metrics", "/healthz", "/readyz":
+		return a.serve(w, r)
+	}
+
+	if !a.proxy.crawlers.ShouldPrerender(r) {
+		a.proxy.upstream.ServeHTTP(w, r)
+		return nil
+	}
+
+	opts, err := parseOptions(func(name string) string {
+		switch name {
+		case "url":
+			return a.proxy.crawlers.URL(r)
+		case "userAgent":
+			return r.UserAgent()
+		}
+		return ""
+	})
+	if err != nil || !guard.MatchHost(a.proxy.hosts, opts.URL.Hostname()) {
+		a.proxy.upstream.ServeHTTP(w, r)
+		return nil
+	}
+	req := r.WithContext(setOptions(a.context(r.Context()), opts))
+	req.URL = opts.URL
+
+	res, err := getData(req)
+	if err == nil && res.Status < http.StatusInternalServerError {
+		writeResult(res, nil, w, formatHTML)
+		return res
+	}
+	// the page of the origin beats an error
+	if err == nil {
+		err = errors.Errorf("rendering responded %d", res.Status)
+	}
+	log.WithError(err).WithField("url", opts.URL.String()).Warn("rendering failed, proxying to upstream")
+	a.proxy.upstream.ServeHTTP(w, r)
+	return nil
+}
@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/pkg/errors"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second and holding
+// at most Burst tokens. The zero Limit allows everything
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseLimit parses limits written as "requests/period", like "10/s" or
+// "100/1m", with an optional ",burst" suffix. The burst defaults to the
+// number of requests
+func ParseLimit(s string) (Limit, error) {
+	if s == "" {
+		return Limit{}, nil
+	}
+	spec, burstSpec := s, ""
+	if i := strings.Index(s, ","); i >= 0 {
+		spec, burstSpec = s[:i], s[i+1:]
+	}
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected requests/period", s)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q, requests must be a positive integer", s)
+	}
+	period := parts[1]
+	if period == "s" || period == "m" || period == "h" {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q, bad period", s)
+	}
+
+	l := Limit{Rate: float64(n) / d.Seconds(), Burst: n}
+	if burstSpec != "" {
+		if l.Burst, err = strconv.Atoi(burstSpec); err != nil || l.Burst <= 0 {
+			return Limit{}, fmt.Errorf("invalid limit %q, bad burst", s)
+		}
+	}
+	return l, nil
+}
+
+// UnmarshalText lets limits be written as strings in configuration files
+func (l *Limit) UnmarshalText(text []byte) error {
+	parsed, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Unlimited reports whether l allows everything
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// LimitedError is returned when a limit is exceeded
+type LimitedError struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry after %s", e.Key, e.RetryAfter)
+}
+
+// Limiter takes tokens from buckets identified by key
+type Limiter interface {
+	// Allow takes a token from the bucket of key, returning a
+	// *LimitedError if there is none left
+	Allow(key string, l Limit) error
+}
+
+// MemoryLimiter keeps buckets in memory, limits only hold per process
+type MemoryLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// NewMemoryLimiter creates a limiter keeping its buckets in memory
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: map[string]*bucket{}}
+}
+
+// sweepEvery is how many calls to Allow happen between two removals of
+// the full buckets
+const sweepEvery = 1000
+
+func (m *MemoryLimiter) Allow(key string, l Limit) error {
+	if l.Unlimited() {
+		return nil
+	}
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.calls++
+	if m.calls%sweepEvery == 0 {
+		for k, b := range m.buckets {
+			if b.refill(now) >= float64(b.limit.Burst) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.limit = l
+	b.tokens = b.refill(now)
+	b.updated = now
+	if b.tokens < 1 {
+		return &LimitedError{Key: key, RetryAfter: waitFor(b.tokens, l)}
+	}
+	b.tokens--
+	return nil
+}
+
+func (b *bucket) refill(now time.Time) float64 {
+	return math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+}
+
+// waitFor returns how long it takes for the bucket to hold one token
+func waitFor(tokens float64, l Limit) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) / l.Rate * float64(time.Second)))
+}
+
+// RedisLimiter keeps buckets in Redis so limits hold across replicas
+type RedisLimiter struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisLimiter creates a limiter keeping its buckets in Redis
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+	return &RedisLimiter{client: client, prefix: "prerender:ratelimit:"}
+}
+
+// takeToken refills and takes a token from the bucket atomically,
+// returning whether a token was taken and the milliseconds to wait if not
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(data[1]) or burst
+local updated = tonumber(data[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+func (r *RedisLimiter) Close() error {
+	return r.client.Close()
+}
+
+func (r *RedisLimiter) Allow(key string, l Limit) error {
+	if l.Unlimited() {
+		return nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	res, err := takeToken.Run(r.client, []string{r.prefix + key}, l.Rate, l.Burst, now).Result()
+	if err != nil {
+		return errors.Wrap(err, "rate limit check failed")
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return errors.New("unexpected rate limit script result")
+	}
+	if allowed, _ := values[0].(int64); allowed == 1 {
+		return nil
+	}
+	wait, _ := values[1].(int64)
+	return &LimitedError{Key: key, RetryAfter: time.Duration(wait) * time.Millisecond}
+}
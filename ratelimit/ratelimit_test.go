@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	l, err := ParseLimit("10/s")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 10, Burst: 10}, l)
+
+	l, err = ParseLimit("120/2m,5")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 1, Burst: 5}, l)
+
+	l, err = ParseLimit("")
+	require.NoError(t, err)
+	assert.True(t, l.Unlimited())
+
+	for _, s := range []string{"10", "x/s", "0/s", "10/forever", "10/s,none"} {
+		_, err = ParseLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func testLimiter(t *testing.T, limiter Limiter) {
+	l := Limit{Rate: 1, Burst: 2}
+	assert.NoError(t, limiter.Allow("a", l))
+	assert.NoError(t, limiter.Allow("a", l))
+
+	err := limiter.Allow("a", l)
+	require.IsType(t, &LimitedError{}, err)
+	retry := err.(*LimitedError).RetryAfter
+	assert.True(t, retry > 0 && retry <= time.Second, retry.String())
+
+	// buckets are independent
+	assert.NoError(t, limiter.Allow("b", l))
+	assert.NoError(t, limiter.Allow("a", Limit{}))
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	testLimiter(t, limiter)
+
+	fast := Limit{Rate: 1000, Burst: 1}
+	assert.NoError(t, limiter.Allow("c", fast))
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, limiter.Allow("c", fast))
+}
+
+func TestRedisLimiter(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	testLimiter(t, NewRedisLimiter(redis.NewClient(&redis.Options{Addr: s.Addr()})))
+}
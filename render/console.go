@@ -0,0 +1,143 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/wirepair/gcd/gcdapi"
+)
+
+const (
+	// maxConsoleMessages and maxExceptions bound what is kept of a
+	// render, so a page logging in a loop can't grow its result forever
+	maxConsoleMessages = 100
+	maxExceptions      = 20
+	// maxMessageLength truncates the text of messages and stacks
+	maxMessageLength = 2000
+	// maxConsoleErrors bounds the strings of Result.ConsoleErrors
+	maxConsoleErrors = 50
+)
+
+// ConsoleMessage is a message logged by a rendered page, through the
+// console API or by Chrome itself
+type ConsoleMessage struct {
+	// Level is debug, log, info, warning or error, or verbose for the
+	// messages of Chrome
+	Level string `json:"level"`
+	// Source is console for the console API, otherwise the part of Chrome
+	// which logged the message: network, security, javascript...
+	Source string `json:"source"`
+	Text   string `json:"text"`
+	URL    string `json:"url,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// Exception is an uncaught exception of a rendered page
+type Exception struct {
+	Message string `json:"message"`
+	URL     string `json:"url,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Stack   string `json:"stack,omitempty"`
+}
+
+// consoleLevel maps the type of a console API call to its level
+func consoleLevel(t string) string {
+	switch t {
+	case "error", "assert":
+		return "error"
+	case "warning", "info", "debug":
+		return t
+	}
+	return "log"
+}
+
+func consoleMessage(event *gcdapi.RuntimeConsoleAPICalledEvent) ConsoleMessage {
+	msg := ConsoleMessage{
+		Level:  consoleLevel(event.Params.Type),
+		Source: "console",
+		Text:   truncate(remoteObjectsString(event.Params.Args)),
+	}
+	if frame := topFrame(event.Params.StackTrace); frame != nil {
+		msg.URL, msg.Line = frame.Url, frame.LineNumber+1
+	}
+	return msg
+}
+
+func logMessage(entry *gcdapi.LogLogEntry) ConsoleMessage {
+	msg := ConsoleMessage{Level: entry.Level, Source: entry.Source, Text: truncate(entry.Text), URL: entry.Url}
+	if frame := topFrame(entry.StackTrace); frame != nil {
+		msg.URL, msg.Line = frame.Url, frame.LineNumber+1
+	} else if entry.LineNumber > 0 {
+		msg.Line = entry.LineNumber + 1
+	}
+	return msg
+}
+
+func exception(details *gcdapi.RuntimeExceptionDetails) Exception {
+	// devtools numbers lines and columns from 0
+	e := Exception{Message: details.Text, URL: details.Url, Line: details.LineNumber + 1, Column: details.ColumnNumber + 1}
+	if details.Exception != nil && details.Exception.Description != "" {
+		// the description of an error is its message then its stack
+		lines := strings.SplitN(details.Exception.Description, "\n", 2)
+		e.Message = lines[0]
+		if len(lines) > 1 {
+			e.Stack = lines[1]
+		}
+	}
+	if e.Stack == "" && details.StackTrace != nil {
+		frames := make([]string, 0, len(details.StackTrace.CallFrames))
+		for _, f := range details.StackTrace.CallFrames {
+			name := f.FunctionName
+			if name == "" {
+				name = "<anonymous>"
+			}
+			frames = append(frames, fmt.Sprintf("    at %s (%s:%d:%d)", name, f.Url, f.LineNumber+1, f.ColumnNumber+1))
+		}
+		e.Stack = strings.Join(frames, "\n")
+	}
+	e.Message = truncate(e.Message)
+	e.Stack = truncate(e.Stack)
+	return e
+}
+
+// consoleErrors lists the exceptions, with their stack, then the errors
+// logged through the console API
+func consoleErrors(exceptions []Exception, console []ConsoleMessage) []string {
+	var errs []string
+	for _, e := range exceptions {
+		msg := e.Message
+		if e.Stack != "" {
+			msg += "\n" + e.Stack
+		}
+		errs = append(errs, msg)
+	}
+	for _, msg := range console {
+		if msg.Source == "console" && msg.Level == "error" {
+			errs = append(errs, msg.Text)
+		}
+	}
+	if len(errs) > maxConsoleErrors {
+		errs = errs[:maxConsoleErrors]
+	}
+	return errs
+}
+
+func topFrame(stack *gcdapi.RuntimeStackTrace) *gcdapi.RuntimeCallFrame {
+	if stack == nil || len(stack.CallFrames) == 0 {
+		return nil
+	}
+	return stack.CallFrames[0]
+}
+
+func truncate(s string) string {
+	if len(s) <= maxMessageLength {
+		return s
+	}
+	end := maxMessageLength
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "…"
+}
@@ -0,0 +1,117 @@
+package render
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wirepair/gcd/gcdapi"
+)
+
+func TestConsoleMessage(t *testing.T) {
+	event := &gcdapi.RuntimeConsoleAPICalledEvent{}
+	event.Params.Type = "assert"
+	event.Params.Args = []*gcdapi.RuntimeRemoteObject{
+		{Type: "string", Value: "failed:"},
+		{Type: "object", Description: "Error: boom"},
+		{Type: "number", Value: 42},
+	}
+	event.Params.StackTrace = &gcdapi.RuntimeStackTrace{CallFrames: []*gcdapi.RuntimeCallFrame{
+		{Url: "https://www.netlify.com/app.js", LineNumber: 9},
+		{Url: "https://www.netlify.com/vendor.js", LineNumber: 99},
+	}}
+	assert.Equal(t, ConsoleMessage{
+		Level: "error", Source: "console", Text: "failed: Error: boom 42",
+		URL: "https://www.netlify.com/app.js", Line: 10,
+	}, consoleMessage(event))
+
+	for typ, level := range map[string]string{"error": "error", "warning": "warning", "info": "info", "debug": "debug", "log": "log", "table": "log", "dir": "log"} {
+		event := &gcdapi.RuntimeConsoleAPICalledEvent{}
+		event.Params.Type = typ
+		assert.Equal(t, ConsoleMessage{Level: level, Source: "console"}, consoleMessage(event), typ)
+	}
+}
+
+func TestLogMessage(t *testing.T) {
+	assert.Equal(t, ConsoleMessage{
+		Level: "error", Source: "network", Text: "Failed to load resource",
+		URL: "https://www.netlify.com/missing.png",
+	}, logMessage(&gcdapi.LogLogEntry{Level: "error", Source: "network", Text: "Failed to load resource", Url: "https://www.netlify.com/missing.png"}))
+
+	assert.Equal(t, ConsoleMessage{
+		Level: "warning", Source: "security", Text: "Mixed content",
+		URL: "https://www.netlify.com/", Line: 3,
+	}, logMessage(&gcdapi.LogLogEntry{Level: "warning", Source: "security", Text: "Mixed content", Url: "https://www.netlify.com/", LineNumber: 2}))
+
+	msg := logMessage(&gcdapi.LogLogEntry{
+		Level: "verbose", Source: "javascript", Text: "slow handler", Url: "https://www.netlify.com/", LineNumber: 2,
+		StackTrace: &gcdapi.RuntimeStackTrace{CallFrames: []*gcdapi.RuntimeCallFrame{{Url: "https://www.netlify.com/app.js", LineNumber: 0}}},
+	})
+	assert.Equal(t, "https://www.netlify.com/app.js", msg.URL)
+	assert.Equal(t, 1, msg.Line)
+}
+
+func TestException(t *testing.T) {
+	e := exception(&gcdapi.RuntimeExceptionDetails{
+		Text: "Uncaught", Url: "https://www.netlify.com/app.js", LineNumber: 0, ColumnNumber: 4,
+		Exception: &gcdapi.RuntimeRemoteObject{
+			Description: "TypeError: Cannot read properties of undefined (reading 'map')\n    at App (app.js:1:5)",
+		},
+	})
+	assert.Equal(t, Exception{
+		Message: "TypeError: Cannot read properties of undefined (reading 'map')",
+		URL:     "https://www.netlify.com/app.js", Line: 1, Column: 5,
+		Stack: "    at App (app.js:1:5)",
+	}, e)
+
+	// values thrown which aren't errors have no stack in their description
+	e = exception(&gcdapi.RuntimeExceptionDetails{
+		Text: "Uncaught", LineNumber: 1, ColumnNumber: 0,
+		Exception: &gcdapi.RuntimeRemoteObject{Type: "string", Value: "oops"},
+		StackTrace: &gcdapi.RuntimeStackTrace{CallFrames: []*gcdapi.RuntimeCallFrame{
+			{FunctionName: "render", Url: "https://www.netlify.com/app.js", LineNumber: 1, ColumnNumber: 0},
+			{Url: "https://www.netlify.com/app.js", LineNumber: 9, ColumnNumber: 2},
+		}},
+	})
+	assert.Equal(t, "Uncaught", e.Message)
+	assert.Equal(t, "    at render (https://www.netlify.com/app.js:2:1)\n    at <anonymous> (https://www.netlify.com/app.js:10:3)", e.Stack)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short"))
+	long := strings.Repeat("a", maxMessageLength)
+	assert.Equal(t, long, truncate(long))
+	assert.Equal(t, long+"…", truncate(long+"b"))
+
+	// multi-byte characters aren't cut
+	s := truncate(strings.Repeat("a", maxMessageLength-1) + "ééé")
+	assert.Equal(t, strings.Repeat("a", maxMessageLength-1)+"…", s)
+
+	event := &gcdapi.RuntimeConsoleAPICalledEvent{}
+	event.Params.Args = []*gcdapi.RuntimeRemoteObject{{Type: "string", Value: strings.Repeat("x", 3*maxMessageLength)}}
+	assert.Len(t, consoleMessage(event).Text, maxMessageLength+len("…"))
+	e := exception(&gcdapi.RuntimeExceptionDetails{
+		Exception: &gcdapi.RuntimeRemoteObject{Description: "Error\n" + strings.Repeat("    at f (app.js:1:1)\n", 200)},
+	})
+	assert.Len(t, e.Stack, maxMessageLength+len("…"))
+}
+
+func TestConsoleErrors(t *testing.T) {
+	errs := consoleErrors([]Exception{
+		{Message: "TypeError: boom", Stack: "    at App (app.js:1:5)"},
+		{Message: "Uncaught oops"},
+	}, []ConsoleMessage{
+		{Level: "error", Source: "console", Text: "request failed"},
+		{Level: "error", Source: "network", Text: "Failed to load resource"},
+		{Level: "warning", Source: "console", Text: "deprecated"},
+	})
+	assert.Equal(t, []string{"TypeError: boom\n    at App (app.js:1:5)", "Uncaught oops", "request failed"}, errs)
+
+	assert.Nil(t, consoleErrors(nil, []ConsoleMessage{{Level: "log", Source: "console", Text: "started"}}))
+
+	console := make([]ConsoleMessage, maxConsoleMessages)
+	for i := range console {
+		console[i] = ConsoleMessage{Level: "error", Source: "console", Text: "error"}
+	}
+	assert.Len(t, consoleErrors(nil, console), maxConsoleErrors)
+}
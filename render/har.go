@@ -0,0 +1,451 @@
+package render
+
+import (
+	"fmt"
+	"math"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wirepair/gcd/gcdapi"
+)
+
+// maxHAREntries bounds the requests recorded for a render
+const maxHAREntries = 1000
+
+// HAR is an HTTP Archive 1.2 document of the network activity of a render,
+// see http://www.softwareishard.com/blog/har-12-spec/. Fields starting
+// with an underscore are custom fields, as the spec allows
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the root of a HAR document
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Pages   []HARPage  `json:"pages"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator is the application which recorded a HAR
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HARPage is the rendered page
+type HARPage struct {
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
+}
+
+// HARPageTimings are the milliseconds from the start of the page to its
+// events, -1 when the page didn't fire them
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+// HAREntry is a request made by the page. A redirected request has an
+// entry for each hop
+type HAREntry struct {
+	PageRef         string      `json:"pageref"`
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	// ResourceType is document, script, xhr...
+	ResourceType string `json:"_resourceType,omitempty"`
+	// Initiator is the URL of the document or script which made the request
+	Initiator string `json:"_initiator,omitempty"`
+	// Error is why the request failed, BlockedReason why Chrome blocked it
+	Error         string `json:"_error,omitempty"`
+	BlockedReason string `json:"_blockedReason,omitempty"`
+	// Pending is set on the requests which didn't finish before the end of
+	// the render, they don't hold the page done detection but are cut
+	Pending bool `json:"_pending,omitempty"`
+	// TransferSize is the number of bytes received, headers included
+	TransferSize int64 `json:"_transferSize"`
+}
+
+// HARRequest is the request of an entry
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse is the response of an entry, with a 0 status when there was
+// none
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARContent describes the body of a response, which isn't recorded
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// HARNameValue is a header or query string parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARTimings are the milliseconds spent in each phase of a request, -1
+// when a phase doesn't apply
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+const harPageID = "page_1"
+
+// harRecorder builds a HAR from the Network events of a tab. Events are
+// dispatched concurrently, so the recorder has its own lock. Its methods
+// do nothing on a nil recorder, the HAR being opt-in
+type harRecorder struct {
+	mu sync.Mutex
+	// requests are the current hops, by request id
+	requests map[string]*harRequest
+	entries  []*harRequest
+	// start and last are the first and last timestamps of the events,
+	// the monotonic clock of Chrome in seconds
+	start, last   float64
+	started       time.Time
+	onContentLoad float64
+	onLoad        float64
+}
+
+type harRequest struct {
+	entry HAREntry
+	// started and finished are the timestamps of the request
+	started, finished float64
+	timing            *gcdapi.NetworkResourceTiming
+}
+
+func newHARRecorder() *harRecorder {
+	return &harRecorder{requests: map[string]*harRequest{}, onContentLoad: -1, onLoad: -1}
+}
+
+func (h *harRecorder) requestWillBeSent(event *gcdapi.NetworkRequestWillBeSentEvent) {
+	if h == nil || event.Params.Request == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	p := event.Params
+	h.seen(p.Timestamp)
+
+	// a redirect is a new request with the same id, which carries the
+	// response of the previous hop
+	if prev := h.requests[p.RequestId]; prev != nil && p.RedirectResponse != nil {
+		prev.response(p.RedirectResponse)
+		prev.entry.Response.RedirectURL = p.Request.Url
+		prev.finished = p.Timestamp
+	}
+	if len(h.entries) >= maxHAREntries {
+		delete(h.requests, p.RequestId)
+		return
+	}
+
+	// older Chrome versions send no wall time
+	started := time.Now()
+	if p.WallTime > 0 {
+		started = time.Unix(0, int64(p.WallTime*float64(time.Second)))
+	} else if !h.started.IsZero() {
+		started = h.started.Add(time.Duration((p.Timestamp - h.start) * float64(time.Second)))
+	}
+	if h.started.IsZero() {
+		h.start, h.started = p.Timestamp, started
+	}
+	req := &harRequest{started: p.Timestamp}
+	req.entry = HAREntry{
+		PageRef:         harPageID,
+		StartedDateTime: started,
+		Request: HARRequest{
+			Method:      p.Request.Method,
+			URL:         p.Request.Url,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(p.Request.Headers),
+			QueryString: harQueryString(p.Request.Url),
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: HARResponse{
+			Cookies:     []HARNameValue{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		ResourceType: strings.ToLower(p.Type),
+		Initiator:    initiatorURL(p.Initiator),
+	}
+	h.requests[p.RequestId] = req
+	h.entries = append(h.entries, req)
+}
+
+func (h *harRecorder) responseReceived(event *gcdapi.NetworkResponseReceivedEvent) {
+	if h == nil || event.Params.Response == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen(event.Params.Timestamp)
+	if req := h.requests[event.Params.RequestId]; req != nil {
+		req.response(event.Params.Response)
+		if req.entry.ResourceType == "" {
+			req.entry.ResourceType = strings.ToLower(event.Params.Type)
+		}
+	}
+}
+
+func (h *harRecorder) dataReceived(event *gcdapi.NetworkDataReceivedEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen(event.Params.Timestamp)
+	if req := h.requests[event.Params.RequestId]; req != nil {
+		req.entry.Response.Content.Size += int64(event.Params.DataLength)
+	}
+}
+
+func (h *harRecorder) loadingFinished(event *gcdapi.NetworkLoadingFinishedEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen(event.Params.Timestamp)
+	if req := h.requests[event.Params.RequestId]; req != nil {
+		req.entry.TransferSize = int64(event.Params.EncodedDataLength)
+		req.finished = event.Params.Timestamp
+	}
+}
+
+func (h *harRecorder) loadingFailed(event *gcdapi.NetworkLoadingFailedEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seen(event.Params.Timestamp)
+	if req := h.requests[event.Params.RequestId]; req != nil {
+		req.entry.Error = event.Params.ErrorText
+		req.entry.BlockedReason = event.Params.BlockedReason
+		req.finished = event.Params.Timestamp
+	}
+}
+
+func (h *harRecorder) domContentEventFired(timestamp float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.onContentLoad = h.sinceStart(timestamp)
+	h.mu.Unlock()
+}
+
+func (h *harRecorder) loadEventFired(timestamp float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.onLoad = h.sinceStart(timestamp)
+	h.mu.Unlock()
+}
+
+// har returns the HAR of what was recorded so far
+func (h *harRecorder) har(title string) *HAR {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	started := h.started
+	if started.IsZero() {
+		started = time.Now()
+	}
+	har := &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "prerender", Version: "1.0"},
+		Pages: []HARPage{{
+			StartedDateTime: started,
+			ID:              harPageID,
+			Title:           title,
+			PageTimings:     HARPageTimings{OnContentLoad: h.onContentLoad, OnLoad: h.onLoad},
+		}},
+		Entries: make([]HAREntry, 0, len(h.entries)),
+	}}
+	for _, req := range h.entries {
+		entry := req.entry
+		end := req.finished
+		if end == 0 {
+			entry.Pending = true
+			end = h.last
+		}
+		entry.Timings = req.timings(end)
+		entry.Time = ms(end - req.started)
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+	return har
+}
+
+func (h *harRecorder) seen(timestamp float64) {
+	if timestamp > h.last {
+		h.last = timestamp
+	}
+}
+
+func (h *harRecorder) sinceStart(timestamp float64) float64 {
+	if h.start == 0 || timestamp < h.start {
+		return -1
+	}
+	return ms(timestamp - h.start)
+}
+
+func (r *harRequest) response(res *gcdapi.NetworkResponse) {
+	r.entry.Response.Status = res.Status
+	r.entry.Response.StatusText = res.StatusText
+	r.entry.Response.HTTPVersion = httpVersion(res.Protocol)
+	r.entry.Response.Headers = harHeaders(res.Headers)
+	r.entry.Response.Content.MimeType = res.MimeType
+	r.entry.Request.HTTPVersion = r.entry.Response.HTTPVersion
+	// the headers actually sent, the request event only knows some
+	if len(res.RequestHeaders) > 0 {
+		r.entry.Request.Headers = harHeaders(res.RequestHeaders)
+	}
+	r.entry.ServerIPAddress = strings.Trim(res.RemoteIPAddress, "[]")
+	r.timing = res.Timing
+}
+
+// timings splits the duration of the request from the resource timing of
+// its response, which is in milliseconds from its requestTime
+func (r *harRequest) timings(end float64) HARTimings {
+	t := HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1}
+	rt := r.timing
+	if rt == nil || rt.RequestTime == 0 {
+		// served from the memory cache, blocked or failed
+		t.Wait = ms(end - r.started)
+		return t
+	}
+	queued := ms(rt.RequestTime - r.started)
+	if queued < 0 {
+		queued = 0
+	}
+	t.Blocked = queued + rt.SendStart
+	for _, start := range []float64{rt.ConnectStart, rt.DnsStart} {
+		if start >= 0 {
+			t.Blocked = queued + start
+		}
+	}
+	if rt.DnsStart >= 0 {
+		t.DNS = rt.DnsEnd - rt.DnsStart
+	}
+	if rt.ConnectStart >= 0 {
+		t.Connect = rt.ConnectEnd - rt.ConnectStart
+	}
+	if rt.SslStart >= 0 {
+		t.SSL = rt.SslEnd - rt.SslStart
+	}
+	t.Send = nonNegative(rt.SendEnd - rt.SendStart)
+	t.Wait = nonNegative(rt.ReceiveHeadersEnd - rt.SendEnd)
+	t.Receive = nonNegative(ms(end-rt.RequestTime) - rt.ReceiveHeadersEnd)
+	return t
+}
+
+func harHeaders(headers map[string]interface{}) []HARNameValue {
+	nv := make([]HARNameValue, 0, len(headers))
+	for name, value := range headers {
+		// headers received several times are joined by newlines
+		for _, v := range strings.Split(fmt.Sprint(value), "\n") {
+			nv = append(nv, HARNameValue{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(nv, func(i, j int) bool {
+		return nv[i].Name < nv[j].Name
+	})
+	return nv
+}
+
+func harQueryString(rawurl string) []HARNameValue {
+	nv := []HARNameValue{}
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return nv
+	}
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range query[name] {
+			nv = append(nv, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return nv
+}
+
+func initiatorURL(initiator *gcdapi.NetworkInitiator) string {
+	if initiator == nil {
+		return ""
+	}
+	if frame := topFrame(initiator.Stack); frame != nil {
+		return frame.Url
+	}
+	return initiator.Url
+}
+
+// httpVersion maps the protocol of a response to the HAR version names
+func httpVersion(protocol string) string {
+	switch protocol {
+	case "":
+		return ""
+	case "h2":
+		return "HTTP/2.0"
+	}
+	return strings.ToUpper(protocol)
+}
+
+// ms converts seconds to milliseconds, rounded to the microsecond
+func ms(seconds float64) float64 {
+	return math.Floor(seconds*1e6+0.5) / 1000
+}
+
+func nonNegative(f float64) float64 {
+	if f < 0 {
+		return 0
+	}
+	return f
+}
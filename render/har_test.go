@@ -0,0 +1,217 @@
+package render
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wirepair/gcd/gcdapi"
+)
+
+func requestEvent(id, url string, timestamp, wallTime float64) *gcdapi.NetworkRequestWillBeSentEvent {
+	event := &gcdapi.NetworkRequestWillBeSentEvent{}
+	event.Params.RequestId = id
+	event.Params.Request = &gcdapi.NetworkRequest{Url: url, Method: "GET", Headers: map[string]interface{}{}}
+	event.Params.Timestamp = timestamp
+	event.Params.WallTime = wallTime
+	return event
+}
+
+func responseEvent(id string, timestamp float64, res *gcdapi.NetworkResponse) *gcdapi.NetworkResponseReceivedEvent {
+	event := &gcdapi.NetworkResponseReceivedEvent{}
+	event.Params.RequestId = id
+	event.Params.Timestamp = timestamp
+	event.Params.Response = res
+	return event
+}
+
+func finishedEvent(id string, timestamp float64) *gcdapi.NetworkLoadingFinishedEvent {
+	event := &gcdapi.NetworkLoadingFinishedEvent{}
+	event.Params.RequestId = id
+	event.Params.Timestamp = timestamp
+	return event
+}
+
+func TestHARRedirects(t *testing.T) {
+	h := newHARRecorder()
+	first := requestEvent("1", "http://netlify.com/", 100, 1500000000)
+	first.Params.Type = "Document"
+	h.requestWillBeSent(first)
+
+	second := requestEvent("1", "https://www.netlify.com/?b=2&a=1", 100.1, 0)
+	second.Params.Type = "Document"
+	second.Params.RedirectResponse = &gcdapi.NetworkResponse{
+		Status: 301, StatusText: "Moved Permanently", Protocol: "http/1.1",
+		Headers: map[string]interface{}{"Location": "https://www.netlify.com/?b=2&a=1"},
+	}
+	h.requestWillBeSent(second)
+
+	h.responseReceived(responseEvent("1", 100.3, &gcdapi.NetworkResponse{
+		Status: 200, StatusText: "OK", Protocol: "h2", MimeType: "text/html", RemoteIPAddress: "[2001:db8::1]",
+		Headers:        map[string]interface{}{"Set-Cookie": "a=1\nb=2", "Content-Type": "text/html"},
+		RequestHeaders: map[string]interface{}{"User-Agent": "Chrome"},
+		Timing: &gcdapi.NetworkResourceTiming{
+			RequestTime: 100.15,
+			DnsStart:    0, DnsEnd: 10,
+			ConnectStart: 10, ConnectEnd: 30,
+			SslStart: 20, SslEnd: 30,
+			SendStart: 30, SendEnd: 31,
+			ReceiveHeadersEnd: 131,
+		},
+	}))
+	data := &gcdapi.NetworkDataReceivedEvent{}
+	data.Params.RequestId, data.Params.Timestamp, data.Params.DataLength = "1", 100.4, 1024
+	h.dataReceived(data)
+	finished := finishedEvent("1", 100.5)
+	finished.Params.EncodedDataLength = 600
+	h.loadingFinished(finished)
+	h.domContentEventFired(100.2)
+
+	har := h.har("Netlify")
+	require.Len(t, har.Log.Pages, 1)
+	page := har.Log.Pages[0]
+	assert.Equal(t, "Netlify", page.Title)
+	assert.Equal(t, time.Unix(1500000000, 0), page.StartedDateTime)
+	assert.Equal(t, HARPageTimings{OnContentLoad: 200, OnLoad: -1}, page.PageTimings)
+
+	require.Len(t, har.Log.Entries, 2)
+	redirect := har.Log.Entries[0]
+	assert.Equal(t, time.Unix(1500000000, 0), redirect.StartedDateTime)
+	assert.Equal(t, 301, redirect.Response.Status)
+	assert.Equal(t, "HTTP/1.1", redirect.Response.HTTPVersion)
+	assert.Equal(t, "https://www.netlify.com/?b=2&a=1", redirect.Response.RedirectURL)
+	assert.Equal(t, float64(100), redirect.Time)
+	assert.Equal(t, HARTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: 100}, redirect.Timings)
+	assert.False(t, redirect.Pending)
+
+	entry := har.Log.Entries[1]
+	assert.WithinDuration(t, time.Unix(1500000000, 100000000), entry.StartedDateTime, time.Millisecond)
+	assert.Equal(t, "document", entry.ResourceType)
+	assert.Equal(t, []HARNameValue{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}}, entry.Request.QueryString)
+	assert.Equal(t, []HARNameValue{{Name: "User-Agent", Value: "Chrome"}}, entry.Request.Headers)
+	assert.Equal(t, "HTTP/2.0", entry.Request.HTTPVersion)
+	assert.Equal(t, 200, entry.Response.Status)
+	assert.Equal(t, []HARNameValue{
+		{Name: "Content-Type", Value: "text/html"},
+		{Name: "Set-Cookie", Value: "a=1"},
+		{Name: "Set-Cookie", Value: "b=2"},
+	}, entry.Response.Headers)
+	assert.Equal(t, HARContent{Size: 1024, MimeType: "text/html"}, entry.Response.Content)
+	assert.Equal(t, int64(600), entry.TransferSize)
+	assert.Equal(t, "2001:db8::1", entry.ServerIPAddress)
+	assert.Equal(t, float64(400), entry.Time)
+	assert.Equal(t, HARTimings{Blocked: 50, DNS: 10, Connect: 20, SSL: 10, Send: 1, Wait: 100, Receive: 219}, entry.Timings)
+}
+
+func TestHARPendingAndBlocked(t *testing.T) {
+	h := newHARRecorder()
+	h.requestWillBeSent(requestEvent("1", "https://www.netlify.com/", 10, 1500000000))
+	h.loadingFinished(finishedEvent("1", 10.2))
+
+	script := requestEvent("2", "https://ads.example.com/ads.js", 10.05, 0)
+	script.Params.Initiator = &gcdapi.NetworkInitiator{
+		Url:   "https://www.netlify.com/",
+		Stack: &gcdapi.RuntimeStackTrace{CallFrames: []*gcdapi.RuntimeCallFrame{{Url: "https://www.netlify.com/app.js"}}},
+	}
+	h.requestWillBeSent(script)
+	failed := &gcdapi.NetworkLoadingFailedEvent{}
+	failed.Params.RequestId, failed.Params.Timestamp = "2", 10.1
+	failed.Params.ErrorText, failed.Params.BlockedReason = "net::ERR_BLOCKED_BY_CLIENT", "inspector"
+	h.loadingFailed(failed)
+
+	h.requestWillBeSent(requestEvent("3", "https://api.netlify.com/user", 10.1, 0))
+	// the last event of the render
+	h.loadingFinished(finishedEvent("unknown", 10.4))
+
+	har := h.har("")
+	require.Len(t, har.Log.Entries, 3)
+	assert.False(t, har.Log.Entries[0].Pending)
+	assert.Equal(t, float64(200), har.Log.Entries[0].Time)
+
+	blocked := har.Log.Entries[1]
+	assert.Equal(t, "https://www.netlify.com/app.js", blocked.Initiator)
+	assert.Equal(t, "net::ERR_BLOCKED_BY_CLIENT", blocked.Error)
+	assert.Equal(t, "inspector", blocked.BlockedReason)
+	assert.Equal(t, 0, blocked.Response.Status)
+	assert.False(t, blocked.Pending)
+	assert.Equal(t, float64(50), blocked.Time)
+
+	pending := har.Log.Entries[2]
+	assert.True(t, pending.Pending)
+	assert.Equal(t, float64(300), pending.Time)
+	assert.Equal(t, float64(300), pending.Timings.Wait)
+}
+
+func TestHARMaxEntries(t *testing.T) {
+	h := newHARRecorder()
+	for i := 0; i <= maxHAREntries; i++ {
+		h.requestWillBeSent(requestEvent(strconv.Itoa(i), "https://www.netlify.com/", 1, 0))
+	}
+	assert.Len(t, h.har("").Log.Entries, maxHAREntries)
+}
+
+func TestHARNilRecorder(t *testing.T) {
+	var h *harRecorder
+	h.requestWillBeSent(requestEvent("1", "https://www.netlify.com/", 1, 0))
+	h.responseReceived(responseEvent("1", 1, &gcdapi.NetworkResponse{Status: 200}))
+	h.dataReceived(&gcdapi.NetworkDataReceivedEvent{})
+	h.loadingFinished(finishedEvent("1", 2))
+	h.loadingFailed(&gcdapi.NetworkLoadingFailedEvent{})
+	h.domContentEventFired(1)
+	h.loadEventFired(2)
+	assert.Nil(t, h.har("Netlify"))
+}
+
+func TestHARJSON(t *testing.T) {
+	h := newHARRecorder()
+	h.requestWillBeSent(requestEvent("1", "https://www.netlify.com/", 1, 1500000000))
+	h.loadEventFired(1.5)
+	b, err := json.Marshal(h.har("Netlify"))
+	require.NoError(t, err)
+
+	var doc struct {
+		Log map[string]json.RawMessage `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(b, &doc))
+	assert.Equal(t, `"1.2"`, string(doc.Log["version"]))
+	assert.JSONEq(t, `{"name": "prerender", "version": "1.0"}`, string(doc.Log["creator"]))
+
+	var pages []map[string]interface{}
+	require.NoError(t, json.Unmarshal(doc.Log["pages"], &pages))
+	require.Len(t, pages, 1)
+	assert.Equal(t, "page_1", pages[0]["id"])
+	assert.Equal(t, "Netlify", pages[0]["title"])
+	assert.Equal(t, map[string]interface{}{"onContentLoad": float64(-1), "onLoad": float64(500)}, pages[0]["pageTimings"])
+	_, err = time.Parse(time.RFC3339Nano, pages[0]["startedDateTime"].(string))
+	assert.NoError(t, err)
+
+	var entries []map[string]interface{}
+	require.NoError(t, json.Unmarshal(doc.Log["entries"], &entries))
+	require.Len(t, entries, 1)
+	entry := entries[0]
+	// the fields the spec requires, with empty lists rather than nulls
+	for _, name := range []string{"pageref", "startedDateTime", "time", "request", "response", "cache", "timings"} {
+		assert.Contains(t, entry, name)
+	}
+	assert.Equal(t, map[string]interface{}{}, entry["cache"])
+	assert.Equal(t, true, entry["_pending"])
+	request := entry["request"].(map[string]interface{})
+	for _, name := range []string{"method", "url", "httpVersion", "cookies", "headers", "queryString", "headersSize", "bodySize"} {
+		assert.Contains(t, request, name)
+	}
+	assert.Equal(t, []interface{}{}, request["cookies"])
+	assert.Equal(t, []interface{}{}, request["queryString"])
+	response := entry["response"].(map[string]interface{})
+	for _, name := range []string{"status", "statusText", "httpVersion", "cookies", "headers", "content", "redirectURL", "headersSize", "bodySize"} {
+		assert.Contains(t, response, name)
+	}
+	assert.Equal(t, []interface{}{}, response["headers"])
+	assert.Equal(t, map[string]interface{}{"size": float64(0), "mimeType": ""}, response["content"])
+	timings := entry["timings"].(map[string]interface{})
+	for _, name := range []string{"blocked", "dns", "connect", "send", "wait", "receive", "ssl"} {
+		assert.Contains(t, timings, name)
+	}
+}
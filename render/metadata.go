@@ -0,0 +1,155 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/Mixelito/prerender/jsonld"
+	"golang.org/x/net/html"
+)
+
+// Metadata is the SEO relevant data found in a rendered page
+type Metadata struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Canonical   string `json:"canonical,omitempty"`
+	// Robots is the content of the robots meta tag, e.g. "noindex"
+	Robots string `json:"robots,omitempty"`
+	// Alternates are the links to the translations of the page
+	Alternates []Alternate `json:"alternates,omitempty"`
+	// OpenGraph and Twitter are the og: and twitter: meta tags by
+	// property, the first one wins when a property is repeated
+	OpenGraph map[string]string `json:"openGraph,omitempty"`
+	Twitter   map[string]string `json:"twitter,omitempty"`
+	H1        []string          `json:"h1,omitempty"`
+	// JSONLD are the valid JSON-LD scripts, compacted
+	JSONLD []json.RawMessage `json:"jsonLd,omitempty"`
+}
+
+// Alternate is a <link rel="alternate" hreflang> of a page
+type Alternate struct {
+	Hreflang string `json:"hreflang"`
+	Href     string `json:"href"`
+}
+
+// ExtractMetadata reads the title, meta tags, canonical and alternate
+// links, headings and JSON-LD scripts from a HTML document
+func ExtractMetadata(doc string) *Metadata {
+	meta := &Metadata{}
+	z := html.NewTokenizer(strings.NewReader(doc))
+	// raw is the element of the text tokens, when it matters
+	var raw string
+	var h1 bytes.Buffer
+	h1Depth := 0
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.TextToken:
+			switch raw {
+			case "title":
+				if meta.Title == "" {
+					meta.Title = strings.TrimSpace(string(z.Text()))
+				}
+			case "ld+json":
+				var compact bytes.Buffer
+				if json.Compact(&compact, z.Text()) == nil {
+					meta.JSONLD = append(meta.JSONLD, json.RawMessage(compact.Bytes()))
+				}
+			case "":
+				if h1Depth > 0 {
+					h1.Write(z.Text())
+				}
+			}
+		case html.EndTagToken:
+			raw = ""
+			if name, _ := z.TagName(); string(name) == "h1" && h1Depth > 0 {
+				if h1Depth--; h1Depth == 0 {
+					if text := strings.Join(strings.Fields(h1.String()), " "); text != "" {
+						meta.H1 = append(meta.H1, text)
+					}
+					h1.Reset()
+				}
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				raw = "title"
+			case "h1":
+				if t.Type == html.StartTagToken {
+					h1Depth++
+				}
+			case "script", "style", "template":
+				raw = t.Data
+				if t.Data == "script" && jsonld.IsType(attr(t, "type")) {
+					raw = "ld+json"
+				}
+			case "meta":
+				meta.addMeta(t)
+			case "link":
+				rel := attr(t, "rel")
+				href := strings.TrimSpace(attr(t, "href"))
+				if HasRel(rel, "canonical") && meta.Canonical == "" {
+					meta.Canonical = href
+				}
+				if hreflang := strings.TrimSpace(attr(t, "hreflang")); HasRel(rel, "alternate") && hreflang != "" {
+					meta.Alternates = append(meta.Alternates, Alternate{Hreflang: hreflang, Href: href})
+				}
+			}
+		}
+	}
+}
+
+func (meta *Metadata) addMeta(t html.Token) {
+	content := strings.TrimSpace(attr(t, "content"))
+	name := strings.ToLower(attr(t, "name"))
+	if name == "" {
+		name = strings.ToLower(attr(t, "property"))
+	}
+	switch {
+	case name == "description":
+		if meta.Description == "" {
+			meta.Description = content
+		}
+	case name == "robots":
+		if meta.Robots == "" {
+			meta.Robots = content
+		}
+	case strings.HasPrefix(name, "og:"):
+		if meta.OpenGraph == nil {
+			meta.OpenGraph = map[string]string{}
+		}
+		if _, ok := meta.OpenGraph[name]; !ok {
+			meta.OpenGraph[name] = content
+		}
+	case strings.HasPrefix(name, "twitter:"):
+		if meta.Twitter == nil {
+			meta.Twitter = map[string]string{}
+		}
+		if _, ok := meta.Twitter[name]; !ok {
+			meta.Twitter[name] = content
+		}
+	}
+}
+
+func attr(t html.Token, name string) string {
+	for _, a := range t.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// HasRel reports whether the rel attribute of a link, a list of
+// case-insensitive tokens, contains token
+func HasRel(rel, token string) bool {
+	for _, value := range strings.Fields(rel) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
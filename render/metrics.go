@@ -0,0 +1,22 @@
+package render
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	tabsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prerender_tabs_in_flight",
+		Help: "Number of Chrome tabs currently rendering a page.",
+	})
+	tabsWaiting = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "prerender_tabs_waiting",
+		Help: "Number of renders waiting for a free Chrome tab.",
+	})
+	chromeTerminations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prerender_chrome_terminations_total",
+		Help: "Number of times the Chrome process terminated.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(tabsInFlight, tabsWaiting, chromeTerminations)
+}
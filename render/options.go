@@ -0,0 +1,33 @@
+package render
+
+import (
+	"context"
+	"time"
+)
+
+// Options tune a single render
+type Options struct {
+	// Wait is how long to keep waiting once the page looks done, for
+	// pages that render after a delay
+	Wait time.Duration
+	// Timeout overrides the page load timeout of the renderer
+	Timeout time.Duration
+	// UserAgent overrides the User-Agent of the incoming request
+	UserAgent string
+	// HAR records the network activity of the page in Result.HAR
+	HAR bool
+}
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of ctx carrying the render options, pass it
+// to Render through the request context
+func WithOptions(ctx context.Context, o Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, o)
+}
+
+// GetOptions returns the render options carried by ctx
+func GetOptions(ctx context.Context) Options {
+	o, _ := ctx.Value(optionsKey{}).(Options)
+	return o
+}
@@ -1,14 +1,23 @@
 package render
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
+	"github.com/Mixelito/prerender/jsonld"
 	"github.com/pkg/errors"
 	"github.com/wirepair/gcd"
 	"github.com/wirepair/gcd/gcdapi"
@@ -23,6 +32,7 @@ var ErrPageLoadTimeout = errors.New("timed out waiting for page load")
 const WAIT_AFTER_LAST_REQUEST = 400 * time.Millisecond
 const PAGE_DONE_CHECK_INTERVAL = 200 * time.Millisecond
 const PAGE_LOAD_TIMEOUT = 20 * time.Second
+const MAX_TABS = 10
 
 // Renderer is the interface implemented by renderers capable of
 // fetching a webpage and returning the HTML after JavaScript has run
@@ -32,49 +42,100 @@ type Renderer interface {
 	Close()
 }
 
+// Pinger is implemented by renderers able to check they can render pages
+type Pinger interface {
+	Ping() error
+}
+
 // Result describes the result of the rendering operation
 type Result struct {
-	URL      string
-	HTML     string
-	Status   int
-	Etag     string
-	Duration time.Duration
-	Cached	 bool
+	URL      string        `json:"url"`
+	HTML     string        `json:"html,omitempty"`
+	Status   int           `json:"status"`
+	Etag     string        `json:"etag,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Cached   bool          `json:"cached"`
+	// FinalURL is the URL of the rendered document after redirects
+	FinalURL        string    `json:"finalUrl,omitempty"`
+	Redirects       []string  `json:"redirects,omitempty"`
+	BlockedRequests int       `json:"blockedRequests"`
+	FailedRequests  int       `json:"failedRequests"`
+	Meta            *Metadata `json:"meta,omitempty"`
+	// ConsoleErrors are the exceptions and console errors as strings,
+	// for older clients
+	ConsoleErrors []string `json:"consoleErrors,omitempty"`
+	// Console and Exceptions are what the page logged and threw, up to
+	// maxConsoleMessages and maxExceptions
+	Console    []ConsoleMessage `json:"console,omitempty"`
+	Exceptions []Exception      `json:"exceptions,omitempty"`
+	// Failure is why a processor found the page broken despite its
+	// status, such a page isn't cached
+	Failure string `json:"failure,omitempty"`
+	// HAR is the network activity of the page, with the HAR option
+	HAR *HAR `json:"har,omitempty"`
+	// StructuredData is the validation of the JSON-LD scripts of the
+	// page, set by the validateJsonLd processor
+	StructuredData *jsonld.Report `json:"structuredData,omitempty"`
+	// Headers are added to the response, they are set by processors
+	Headers http.Header `json:"headers,omitempty"`
 }
 
 type chromeRenderer struct {
 	debugger *gcd.Gcd
 	timeout  time.Duration
+	// tabs limits the number of tabs open at once, Render blocks
+	// until one is available
+	tabs chan struct{}
+	// guard checks every request made by the rendered pages
+	guard *guard.Policy
 }
 
 // NewRenderer launches a headless Google Chrome instance
-// ready to render pages
-func NewRenderer() (Renderer, error) {
-	chromePath := "/Applications/Google Chrome Canary.app/Contents/MacOS/Google Chrome Canary"
-	if os.Getenv("CHROME_PATH") != "" {
-		chromePath = os.Getenv("CHROME_PATH")
-	}
-
+// ready to render pages. policy checks every request made by the pages
+func NewRenderer(c config.Render, policy *guard.Policy) (Renderer, error) {
 	debugger := gcd.NewChromeDebugger()
 	debugger.SetTerminationHandler(func(reason string) {
+		chromeTerminations.Inc()
 		log.Printf("chrome termination: %s\n", reason)
 	})
 	debugger.AddFlags([]string{"--headless", "--disable-gpu"})
-	debugger.StartProcess(chromePath, os.TempDir(), "9222")
+	port := c.DebugPort
+	if port == 0 {
+		var err error
+		if port, err = freePort(); err != nil {
+			return nil, errors.Wrap(err, "finding a free DevTools port failed")
+		}
+	}
+	debugger.StartProcess(c.ChromePath, os.TempDir(), strconv.Itoa(port))
 
-	var timeout time.Duration
-	if os.Getenv("PAGE_LOAD_TIMEOUT") != "" {
-		timeout, _ = time.ParseDuration(os.Getenv("PAGE_LOAD_TIMEOUT")+"ms")
-	}else {
+	timeout := time.Duration(c.Timeout)
+	if timeout <= 0 {
 		timeout = PAGE_LOAD_TIMEOUT
 	}
+	maxTabs := c.MaxTabs
+	if maxTabs <= 0 {
+		maxTabs = MAX_TABS
+	}
 
 	return &chromeRenderer{
 		debugger: debugger,
 		timeout:  timeout,
+		tabs:     make(chan struct{}, maxTabs),
+		guard:    policy,
 	}, nil
 }
 
+// freePort returns a port nothing listens on, so Chrome doesn't collide
+// with another instance on the host
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
 func (r *chromeRenderer) SetPageLoadTimeout(t time.Duration) {
 	r.timeout = t
 }
@@ -83,25 +144,67 @@ func (r *chromeRenderer) Close() {
 	r.debugger.ExitProcess()
 }
 
+// Ping opens and closes a tab, checking Chrome answers on the DevTools
+// connection. It doesn't wait for a free tab, a busy renderer is healthy
+func (r *chromeRenderer) Ping() error {
+	tab, err := r.debugger.NewTab()
+	if err != nil {
+		return errors.Wrap(err, "opening tab failed")
+	}
+	defer r.debugger.CloseTab(tab)
+	_, err = tab.Page.Enable()
+	return errors.Wrap(err, "devtools command failed")
+}
+
 func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
+	tabsWaiting.Inc()
+	r.tabs <- struct{}{}
+	tabsWaiting.Dec()
+	tabsInFlight.Inc()
+	defer func() {
+		tabsInFlight.Dec()
+		<-r.tabs
+	}()
+
 	start := time.Now()
 	navigated := make(chan bool)
 	url := req.URL.String()
+	opts := GetOptions(req.Context())
+	timeout := r.timeout
+	if opts.Timeout > 0 {
+		timeout = opts.Timeout
+	}
+	userAgent := req.UserAgent()
+	if opts.UserAgent != "" {
+		userAgent = opts.UserAgent
+	}
 	res := Result{URL: url}
 	var err error
 
+	var har *harRecorder
+	if opts.HAR {
+		har = newHARRecorder()
+	}
 	var requests = cmap.New()
 	var requestsSuccess = cmap.New()
 	var lastRequestReceivedAt = time.Now()
+	// guards the res fields written by the event handlers below
+	var mu sync.Mutex
+	addConsole := func(msg ConsoleMessage) {
+		mu.Lock()
+		if len(res.Console) < maxConsoleMessages {
+			res.Console = append(res.Console, msg)
+		}
+		mu.Unlock()
+	}
 
 	var wg sync.WaitGroup
-	tab := startTarget(r.debugger)
-	wg.Add(1)
-
+	tab, err := startTarget(r.debugger)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating new tab failed")
 	}
 	defer r.debugger.CloseTab(tab)
+	wg.Add(1)
 
 	network := tab.Network
 	page := tab.Page
@@ -157,6 +260,30 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 		return nil, errors.Wrap(err, "blocked urls failed: "+url)
 	}
 
+	//check every request made by the page, so an allowed page can't
+	//make Chrome reach internal addresses
+	if !r.guard.AllowPrivate {
+		tab.Subscribe("Network.requestIntercepted", func(target *gcd.ChromeTarget, v []byte) {
+			event := &gcdapi.NetworkRequestInterceptedEvent{}
+			if err := json.Unmarshal(v, event); err != nil {
+				log.Printf("getting intercepted request failed: %s", err)
+				return
+			}
+			rawurl := interceptedURL(event)
+			params := &gcdapi.NetworkContinueInterceptedRequestParams{InterceptionId: event.Params.InterceptionId}
+			if !r.allowRequest(req.Context(), rawurl) {
+				params.ErrorReason = "AccessDenied"
+			}
+			if _, err := target.Network.ContinueInterceptedRequestWithParams(params); err != nil {
+				log.Printf("error continuing request: %s : %s", err, rawurl)
+			}
+		})
+		patterns := []*gcdapi.NetworkRequestPattern{{UrlPattern: "*"}}
+		if _, err = network.SetRequestInterceptionWithParams(&gcdapi.NetworkSetRequestInterceptionParams{Patterns: patterns}); err != nil {
+			return nil, errors.Wrap(err, "request interception failed: "+url)
+		}
+	}
+
 	//when a request enters the execution queue here
 	tab.Subscribe("Network.requestWillBeSent", func(target *gcd.ChromeTarget, v []byte) {
 		event := &gcdapi.NetworkRequestWillBeSentEvent{}
@@ -165,8 +292,13 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 			return
 		}
 
+		har.requestWillBeSent(event)
 		if event.Params.RequestId != "" && event.Params.RequestId != event.Params.LoaderId {
 			requests.Set(event.Params.RequestId, event.Params.Request.Url)
+		} else if event.Params.RedirectResponse != nil {
+			mu.Lock()
+			res.Redirects = append(res.Redirects, event.Params.RedirectResponse.Url)
+			mu.Unlock()
 		}
 	})
 
@@ -179,12 +311,14 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 			log.Printf("getting network response failed: %s", err)
 		}
 
+		har.responseReceived(event)
 		lastRequestReceivedAt = time.Now()
 		if event.Params.RequestId != event.Params.LoaderId {
 			requestsSuccess.Set(event.Params.RequestId, event.Params.Response.Url)
 		}else{
 			r := event.Params.Response
 			res.Status = int(r.Status)
+			res.FinalURL = r.Url
 			if etag, ok := r.Headers["Etag"]; ok {
 				res.Etag = etag.(string)
 			}
@@ -201,11 +335,85 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 			return
 		}
 
+		har.loadingFailed(event)
 		requestsSuccess.Set(event.Params.RequestId, "empty")
+		mu.Lock()
+		if event.Params.BlockedReason != "" {
+			res.BlockedRequests++
+		} else if !event.Params.Canceled {
+			res.FailedRequests++
+		}
+		mu.Unlock()
+	})
+
+	//uncaught exceptions and console.error calls, usually the reason
+	//a page renders blank
+	tab.Subscribe("Runtime.exceptionThrown", func(target *gcd.ChromeTarget, v []byte) {
+		event := &gcdapi.RuntimeExceptionThrownEvent{}
+		if err := json.Unmarshal(v, event); err != nil {
+			log.Printf("getting exception failed: %s", err)
+			return
+		}
+		details := event.Params.ExceptionDetails
+		if details == nil {
+			return
+		}
+		mu.Lock()
+		if len(res.Exceptions) < maxExceptions {
+			res.Exceptions = append(res.Exceptions, exception(details))
+		}
+		mu.Unlock()
+	})
+	tab.Subscribe("Runtime.consoleAPICalled", func(target *gcd.ChromeTarget, v []byte) {
+		event := &gcdapi.RuntimeConsoleAPICalledEvent{}
+		if err := json.Unmarshal(v, event); err != nil {
+			log.Printf("getting console message failed: %s", err)
+			return
+		}
+		addConsole(consoleMessage(event))
 	})
+	//messages of Chrome, like failed resources or CSP violations
+	tab.Subscribe("Log.entryAdded", func(target *gcd.ChromeTarget, v []byte) {
+		event := &gcdapi.LogEntryAddedEvent{}
+		if err := json.Unmarshal(v, event); err != nil {
+			log.Printf("getting log entry failed: %s", err)
+			return
+		}
+		if event.Params.Entry != nil {
+			addConsole(logMessage(event.Params.Entry))
+		}
+	})
+
+	if har != nil {
+		//sizes and ends of requests, only needed by the HAR
+		tab.Subscribe("Network.dataReceived", func(target *gcd.ChromeTarget, v []byte) {
+			event := &gcdapi.NetworkDataReceivedEvent{}
+			if err := json.Unmarshal(v, event); err == nil {
+				har.dataReceived(event)
+			}
+		})
+		tab.Subscribe("Network.loadingFinished", func(target *gcd.ChromeTarget, v []byte) {
+			event := &gcdapi.NetworkLoadingFinishedEvent{}
+			if err := json.Unmarshal(v, event); err == nil {
+				har.loadingFinished(event)
+			}
+		})
+		tab.Subscribe("Page.domContentEventFired", func(target *gcd.ChromeTarget, v []byte) {
+			event := &gcdapi.PageDomContentEventFiredEvent{}
+			if err := json.Unmarshal(v, event); err == nil {
+				har.domContentEventFired(event.Params.Timestamp)
+			}
+		})
+	}
 
 	//when the main page and its directly connected elements are loaded
 	tab.Subscribe("Page.loadEventFired", func(target *gcd.ChromeTarget, v []byte) {
+		if har != nil {
+			event := &gcdapi.PageLoadEventFiredEvent{}
+			if err := json.Unmarshal(v, event); err == nil {
+				har.loadEventFired(event.Params.Timestamp)
+			}
+		}
 		wg.Done()
 	})
 	/*
@@ -219,7 +427,7 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 		log.Printf("error extra http header: %s", err)
 	}
 
-	if _, err = network.SetUserAgentOverride(req.UserAgent()); err != nil {
+	if _, err = network.SetUserAgentOverride(userAgent); err != nil {
 		log.Printf("error change user agent: %s", err)
 	}
 
@@ -227,7 +435,7 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 		return nil, errors.Wrap(err, "navigating to url failed: "+url)
 	}
 
-	stopLoading := time.AfterFunc(r.timeout, func(){
+	stopLoading := time.AfterFunc(timeout, func(){
 		if _, err = tab.Page.StopLoading(); err != nil {
 			log.Printf("error stop loading: %s : %s", err, url)
 		}else{
@@ -242,6 +450,7 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 	if res.Status==http.StatusGatewayTimeout {
 		stopLoading.Stop()
 		res.Duration = time.Since(start)
+		res.HAR = har.har(url)
 		return &res, nil
 	}
 
@@ -269,6 +478,11 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 
 	wg.Wait()
 
+	// give pages that render after a delay a chance to finish
+	if opts.Wait > 0 {
+		time.Sleep(opts.Wait)
+	}
+
 	// events may generate errors
 	if err != nil {
 		return nil, err
@@ -301,19 +515,49 @@ func (r *chromeRenderer) Render(req *http.Request) (*Result, error) {
 	}
 
 	res.Duration = time.Since(start)
+	mu.Lock()
+	res.ConsoleErrors = consoleErrors(res.Exceptions, res.Console)
+	mu.Unlock()
+	// the title of the page is set with its metadata, after the processors
+	res.HAR = har.har(res.FinalURL)
 
 	return &res, nil
 }
 
-func startTarget(debugger *gcd.Gcd) *gcd.ChromeTarget {
+// interceptedURL is the URL Chrome is about to load for an intercepted
+// request. Redirects are reported on the interception of the request they
+// answer, with the URL they lead to
+func interceptedURL(event *gcdapi.NetworkRequestInterceptedEvent) string {
+	if event.Params.RedirectUrl != "" {
+		return event.Params.RedirectUrl
+	}
+	return event.Params.Request.Url
+}
+
+// allowRequest reports whether the page may load rawurl
+func (r *chromeRenderer) allowRequest(ctx context.Context, rawurl string) bool {
+	u, err := neturl.Parse(rawurl)
+	if err == nil {
+		err = r.guard.CheckSubresource(ctx, u)
+	}
+	if err != nil {
+		log.Printf("denied request: %s : %s", err, rawurl)
+		return false
+	}
+	return true
+}
+
+func startTarget(debugger *gcd.Gcd) (*gcd.ChromeTarget, error) {
 	target, err := debugger.NewTab()
 	if err != nil {
-		log.Fatalf("error getting new tab: %s\n", err)
+		return nil, err
 	}
 	//target.Debug(true)
 	//target.DebugEvents(true)
 	target.DOM.Enable()
 	target.Page.Enable()
+	target.Runtime.Enable()
+	target.Log.Enable()
 	//target.Network.Enable(-1, -1)
 	//target.Debugger.Enable()
 
@@ -322,10 +566,25 @@ func startTarget(debugger *gcd.Gcd) *gcd.ChromeTarget {
 		//MaxResourceBufferSize: -1,
 	}
 	if _, err := target.Network.EnableWithParams(networkParams); err != nil {
-		log.Fatal("error enabling network")
+		debugger.CloseTab(target)
+		return nil, errors.Wrap(err, "enabling network failed")
 	}
 
-	return target
+	return target, nil
+}
+
+// remoteObjectsString formats console arguments the way the DevTools
+// console prints them
+func remoteObjectsString(args []*gcdapi.RuntimeRemoteObject) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg.Value != nil {
+			parts = append(parts, fmt.Sprint(arg.Value))
+		} else {
+			parts = append(parts, arg.Description)
+		}
+	}
+	return strings.Join(parts, " ")
 }
 
 func printRequestsInFlight(requests cmap.ConcurrentMap, success cmap.ConcurrentMap) {
@@ -1,6 +1,7 @@
 package render
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,15 +10,25 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/guard"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wirepair/gcd/gcdapi"
 )
 
 var r Renderer
 
 func TestMain(m *testing.M) {
-	var err error
-	r, err = NewRenderer()
+	c := config.Default()
+	c.Render.ChromePath = os.Getenv("CHROME_PATH")
+	// the test servers listen on loopback
+	c.Guard.AllowPrivateIPs = true
+	policy, err := guard.NewPolicy(c.Guard)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err = NewRenderer(c.Render, policy)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -32,7 +43,7 @@ func TestNotFound(t *testing.T) {
 	}))
 	defer server.Close()
 
-	res, err := r.Render(server.URL)
+	res, err := r.Render(httptest.NewRequest("GET", server.URL, nil))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusNotFound, res.Status)
 	assert.Empty(t, res.HTML)
@@ -46,7 +57,7 @@ func TestOriginEtag(t *testing.T) {
 	}))
 	defer server.Close()
 
-	res, err := r.Render(server.URL)
+	res, err := r.Render(httptest.NewRequest("GET", server.URL, nil))
 	require.NoError(t, err)
 	assert.Equal(t, res.Status, http.StatusOK)
 	// Chrome adds html tags
@@ -61,7 +72,7 @@ func TestEtagGenerate(t *testing.T) {
 	}))
 	defer server.Close()
 
-	res, err := r.Render(server.URL)
+	res, err := r.Render(httptest.NewRequest("GET", server.URL, nil))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, res.Status)
 	// Chrome adds html tags
@@ -79,7 +90,7 @@ func TestTimeout(t *testing.T) {
 	}))
 	defer server.Close()
 
-	_, err := r.Render(server.URL)
+	_, err := r.Render(httptest.NewRequest("GET", server.URL, nil))
 	assert.Equal(t, ErrPageLoadTimeout, err)
 }
 
@@ -89,8 +100,73 @@ func TestNXDomain(t *testing.T) {
 	}))
 	defer server.Close()
 
-	res, err := r.Render("http://baddomainasdfasdf.com")
+	res, err := r.Render(httptest.NewRequest("GET", "http://baddomainasdfasdf.com", nil))
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusNotFound, res.Status)
 	assert.Empty(t, res.HTML)
 }
+
+func TestInterceptedRedirect(t *testing.T) {
+	policy, err := guard.NewPolicy(config.Default().Guard)
+	require.NoError(t, err)
+	cr := &chromeRenderer{guard: policy}
+	intercepted := func(url, redirect string) string {
+		event := &gcdapi.NetworkRequestInterceptedEvent{}
+		event.Params.Request = &gcdapi.NetworkRequest{Url: url, Method: "GET"}
+		event.Params.RedirectUrl = redirect
+		return interceptedURL(event)
+	}
+
+	assert.True(t, cr.allowRequest(context.Background(), intercepted("http://93.184.216.34/", "")))
+	// an allowed request redirected to a denied address
+	assert.False(t, cr.allowRequest(context.Background(), intercepted("http://93.184.216.34/", "http://127.0.0.1:8080/admin")))
+	assert.False(t, cr.allowRequest(context.Background(), intercepted("http://93.184.216.34/app.js", "http://169.254.169.254/latest/meta-data/")))
+	assert.True(t, cr.allowRequest(context.Background(), intercepted("http://93.184.216.34/", "https://93.184.216.34/")))
+}
+
+func TestExtractMetadata(t *testing.T) {
+	meta := ExtractMetadata(`<html><head>
+		<title> Netlify </title>
+		<meta name="Description" content="Build, deploy and manage">
+		<link href="https://www.netlify.com/" rel="canonical">
+		</head><body><title>ignored</title></body></html>`)
+	assert.Equal(t, "Netlify", meta.Title)
+	assert.Equal(t, "Build, deploy and manage", meta.Description)
+	assert.Equal(t, "https://www.netlify.com/", meta.Canonical)
+}
+
+func TestExtractSEOMetadata(t *testing.T) {
+	meta := ExtractMetadata(`<html><head>
+		<meta name="robots" content="noindex, follow">
+		<link rel="alternate" hreflang="de" href="https://www.netlify.com/de/">
+		<link rel="alternate" type="application/rss+xml" href="/feed.xml">
+		<meta property="og:title" content="Netlify">
+		<meta property="og:image" content="https://www.netlify.com/1.png">
+		<meta property="og:image" content="https://www.netlify.com/2.png">
+		<meta name="twitter:card" content="summary">
+		<script type="application/ld+json; charset=utf-8">{ "@type": "Organization",
+			"name": "Netlify" }</script>
+		<script type="application/ld+json">{ "@type": </script>
+		<script>document.write("<h1>not a heading</h1>")</script>
+		</head><body><h1> Deploy <b>now</b> </h1><h1></h1><h1>Pricing</h1></body></html>`)
+	assert.Equal(t, "noindex, follow", meta.Robots)
+	assert.Equal(t, []Alternate{{Hreflang: "de", Href: "https://www.netlify.com/de/"}}, meta.Alternates)
+	assert.Equal(t, map[string]string{"og:title": "Netlify", "og:image": "https://www.netlify.com/1.png"}, meta.OpenGraph)
+	assert.Equal(t, map[string]string{"twitter:card": "summary"}, meta.Twitter)
+	assert.Equal(t, []string{"Deploy now", "Pricing"}, meta.H1)
+	require.Len(t, meta.JSONLD, 1)
+	assert.Equal(t, `{"@type":"Organization","name":"Netlify"}`, string(meta.JSONLD[0]))
+}
+
+func TestHasRel(t *testing.T) {
+	assert.True(t, HasRel("canonical", "canonical"))
+	assert.True(t, HasRel(" Canonical  nofollow", "canonical"))
+	assert.True(t, HasRel("Alternate", "alternate"))
+	assert.False(t, HasRel("alternate-canonical", "canonical"))
+	assert.False(t, HasRel("", "canonical"))
+
+	meta := ExtractMetadata(`<link rel="canonical nofollow" href="https://www.netlify.com/">
+		<link rel="Alternate" hreflang="de" href="https://www.netlify.com/de/">`)
+	assert.Equal(t, "https://www.netlify.com/", meta.Canonical)
+	assert.Equal(t, []Alternate{{Hreflang: "de", Href: "https://www.netlify.com/de/"}}, meta.Alternates)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shutdown drains the service: readiness fails right away, requests are
+// still served for delay so load balancers stop routing to us, then the
+// server stops accepting connections and in-flight requests and queued
+// jobs get until timeout to finish before Chrome and the clients close
+func (a *app) shutdown(server *http.Server, delay, timeout time.Duration) {
+	atomic.StoreInt32(&a.draining, 1)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("in-flight requests interrupted")
+	}
+	if a.runner != nil {
+		if err := a.runner.drain(ctx); err != nil {
+			log.WithError(err).Warn("jobs interrupted, they will resume on restart")
+		}
+	}
+	if a.changes != nil {
+		if err := a.changes.Drain(ctx); err != nil {
+			log.WithError(err).Warn("content changes not posted")
+		}
+	}
+
+	a.renderer.Close()
+	closers := []interface{}{a.cache}
+	if a.runner != nil {
+		closers = append(closers, a.runner.store)
+	}
+	if a.limits != nil {
+		closers = append(closers, a.limits.limiter)
+	}
+	for _, c := range closers {
+		if c, ok := c.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.WithError(err).Warn("error closing client")
+			}
+		}
+	}
+	log.Info("shutdown complete")
+}
+
+func (a *app) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) == 1
+}
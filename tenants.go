@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Mixelito/prerender/cache"
+	"github.com/Mixelito/prerender/config"
+	"github.com/Mixelito/prerender/process"
+	"github.com/pkg/errors"
+)
+
+// tenant is a client of the service, identified by its API tokens
+type tenant struct {
+	Name   string   `json:"name"`
+	Tokens []string `json:"tokens"`
+	// AllowedHosts restricts the hosts the tenant may render, on top of
+	// ALLOWED_HOSTS
+	AllowedHosts []string `json:"allowedHosts"`
+	// CacheNamespace prefixes the cache keys of the tenant, defaults to
+	// its name
+	CacheNamespace string `json:"cacheNamespace"`
+	// Options are the default render options of the tenant
+	Options map[string]string `json:"options"`
+	// RateLimits override CLIENT_RATE_LIMIT and ORIGIN_RATE_LIMIT
+	RateLimits tenantLimits `json:"rateLimits"`
+	// Processors replace the HTML pipeline of the service when set
+	Processors []config.Processor `json:"processors"`
+
+	pipeline *process.Pipeline
+}
+
+// withDefaults returns options completed with the tenant defaults
+func (t *tenant) withDefaults(options map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range t.Options {
+		merged[k] = v
+	}
+	for k, v := range options {
+		merged[k] = v
+	}
+	return merged
+}
+
+type tenants []*tenant
+
+// loadTenants reads the tenants from a JSON file. Authentication is
+// disabled when path is empty
+func loadTenants(path string) (tenants, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading tenants failed")
+	}
+	var file struct {
+		Tenants tenants `json:"tenants"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, errors.Wrap(err, "decoding tenants failed")
+	}
+
+	names := map[string]bool{}
+	for _, t := range file.Tenants {
+		if t.Name == "" || names[t.Name] {
+			return nil, errors.Errorf("tenant names must be unique and not empty: %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Tokens) == 0 {
+			return nil, errors.Errorf("tenant %s has no tokens", t.Name)
+		}
+		if t.CacheNamespace == "" {
+			t.CacheNamespace = t.Name
+		}
+		if len(t.Processors) > 0 {
+			if t.pipeline, err = process.NewPipeline(t.Processors); err != nil {
+				return nil, errors.Wrapf(err, "tenant %s", t.Name)
+			}
+		}
+	}
+	return file.Tenants, nil
+}
+
+// authenticate returns the tenant owning the token of the request, sent
+// in the X-Prerender-Token header like the prerender.io middlewares do,
+// or in the token query parameter of the non-legacy endpoints
+func (ts tenants) authenticate(r *http.Request) *tenant {
+	token := r.Header.Get("X-Prerender-Token")
+	if token == "" && !isLegacyPath(r.URL.Path) {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return nil
+	}
+
+	var found *tenant
+	for _, t := range ts {
+		for _, candidate := range t.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(candidate)) == 1 {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+func (ts tenants) byName(name string) *tenant {
+	for _, t := range ts {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// tenantContext scopes the policy, cache and pipeline carried by ctx to
+// the tenant
+func tenantContext(ctx context.Context, t *tenant) context.Context {
+	ctx = setTenant(ctx, t)
+	if t.pipeline != nil {
+		ctx = setPipeline(ctx, t.pipeline)
+	}
+	if policy := getPolicy(ctx); policy != nil {
+		ctx = setPolicy(ctx, policy.Restrict(t.AllowedHosts))
+	}
+	if c := getCache(ctx); c != nil {
+		if ns, ok := c.(cache.Namespacer); ok {
+			ctx = setCache(ctx, ns.WithNamespace(t.CacheNamespace))
+		} else {
+			// never share entries between tenants
+			ctx = setCache(ctx, nil)
+		}
+	}
+	return ctx
+}
+
+// tenantDefaults wraps an option getter to fall back to the default
+// options of the tenant of the request
+func tenantDefaults(r *http.Request, get func(name string) string) func(name string) string {
+	t := getTenant(r.Context())
+	if t == nil {
+		return get
+	}
+	return func(name string) string {
+		if v := get(name); v != "" {
+			return v
+		}
+		return t.Options[name]
+	}
+}